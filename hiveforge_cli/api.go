@@ -2,72 +2,242 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
 )
 
-func sendHashResultToAPI(config Config, jwt *JWT, result *DirectoryHashResult) error {
+// sendManifestToAPI uploads a gzip-compressed streamed manifest and returns
+// the ID the controller stored it under. The body is read straight from the
+// spool file, so its size does not matter. Messages go to out.
+func sendManifestToAPI(out io.Writer, config Config, jwt *JWT, rootPath string, trailer manifestTrailer, manifest *os.File) (string, error) {
 	url := fmt.Sprintf("http://%s:%d/api/v1/hash-results", config.ApiEndpoint, config.Port)
-	fmt.Printf("DEBUG: Preparing to send hash result to URL: %s\n", url)
+	fmt.Fprintf(out, "DEBUG: Preparing to send hash result to URL: %s\n", url)
 
-	// Print some information about the result before encoding
-	fmt.Printf("DEBUG: Result summary:\n")
-	fmt.Printf("  Root Path: %s\n", result.RootPath)
-	fmt.Printf("  Total Files: %d\n", result.TotalFiles)
-	fmt.Printf("  Total Size: %d bytes\n", result.TotalSize)
-	fmt.Printf("  Hashing Time: %.2f seconds\n", result.HashingTime)
+	// Print some information about the result before sending
+	fmt.Fprintf(out, "DEBUG: Result summary:\n")
+	fmt.Fprintf(out, "  Root Path: %s\n", rootPath)
+	fmt.Fprintf(out, "  Total Files: %d\n", trailer.TotalFiles)
+	fmt.Fprintf(out, "  Total Size: %d bytes\n", trailer.TotalSize)
+	fmt.Fprintf(out, "  Hashing Time: %.2f seconds\n", trailer.HashingTime)
 
-	// Encode the result to JSON
-	jsonData, err := json.Marshal(result)
+	info, err := manifest.Stat()
 	if err != nil {
-		return fmt.Errorf("error encoding result to JSON: %w", err)
+		return "", fmt.Errorf("error reading manifest spool file: %w", err)
 	}
+	if _, err := manifest.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("error reading manifest spool file: %w", err)
+	}
+	fmt.Fprintf(out, "DEBUG: Compressed manifest size: %d bytes\n", info.Size())
 
-	var body []byte
-	var contentEncoding string
+	req, err := newAuthenticatedRequest(config, jwt, "POST", url, manifest, "application/x-ndjson", "gzip")
+	if err != nil {
+		return "", fmt.Errorf("error making authenticated request: %w", err)
+	}
+	req.ContentLength = info.Size()
 
-	// Apply gzip compression if the JSON data is large
-	if len(jsonData) > 1024 {
-		var buf bytes.Buffer
-		gzWriter := gzip.NewWriter(&buf)
-		if _, err := gzWriter.Write(jsonData); err != nil {
-			return fmt.Errorf("error compressing JSON data: %w", err)
-		}
-		gzWriter.Close()
-		body = buf.Bytes()
-		contentEncoding = "gzip"
-		fmt.Printf("DEBUG: Compressed data size: %d bytes\n", len(body))
-	} else {
-		body = jsonData
-		contentEncoding = "identity"
-		fmt.Printf("DEBUG: Uncompressed data size: %d bytes\n", len(body))
-	}
-
-	// Make the authenticated request
-	resp, err := makeAuthenticatedRequest(config, jwt, "POST", url, body, contentEncoding)
+	client := &http.Client{}
+	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error making authenticated request: %w", err)
+		return "", fmt.Errorf("error making authenticated request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	fmt.Printf("DEBUG: Response status: %s\n", resp.Status)
-	fmt.Printf("DEBUG: Response headers:\n")
+	fmt.Fprintf(out, "DEBUG: Response status: %s\n", resp.Status)
+	fmt.Fprintf(out, "DEBUG: Response headers:\n")
 	for key, values := range resp.Header {
 		for _, value := range values {
-			fmt.Printf("  %s: %s\n", key, value)
+			fmt.Fprintf(out, "  %s: %s\n", key, value)
 		}
 	}
 
-	body, _ = io.ReadAll(resp.Body)
-	fmt.Printf("DEBUG: Response body: %s\n", string(body))
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Fprintf(out, "DEBUG: Response body: %s\n", string(body))
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API returned non-OK status: %d, body: %s", resp.StatusCode, string(body))
+		return "", fmt.Errorf("API returned non-OK status: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var response struct {
+		Result struct {
+			ID int64 `json:"id"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("error decoding API response: %w", err)
 	}
 
-	fmt.Println("Hash result successfully sent to API, sending result complete.")
+	fmt.Fprintln(out, "Hash result successfully sent to API, sending result complete.")
+	id := fmt.Sprint(response.Result.ID)
+	fmt.Fprintf(out, "Snapshot ID: %s\n", id)
+	return id, nil
+}
+
+// fetchSnapshot downloads the manifest of a hash result stored on the controller.
+func fetchSnapshot(config Config, jwt *JWT, id string) (*DirectoryHashResult, error) {
+	url := fmt.Sprintf("http://%s:%d/api/v1/hash-results/%s", config.ApiEndpoint, config.Port, id)
+
+	resp, err := makeAuthenticatedRequest(config, jwt, "GET", url, nil, "identity")
+	if err != nil {
+		return nil, fmt.Errorf("failed to make authenticated request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch snapshot %s (status %d): %s", id, resp.StatusCode, string(body))
+	}
+
+	return decodeManifest(body, snapshotPrefix+id)
+}
+
+// missingChunks lists the chunks of a hash result the controller has no
+// content for yet.
+type missingChunks struct {
+	Algorithm string   `json:"algorithm"`
+	Missing   []string `json:"missing"`
+	Encodings []string `json:"encodings"` // content encodings accepted for uploads
+}
+
+// fetchMissingChunks asks the controller which chunks of a hash result it has
+// no content for yet, and which algorithm their digests use.
+func fetchMissingChunks(config Config, jwt *JWT, id string) (*missingChunks, error) {
+	url := fmt.Sprintf("http://%s:%d/api/v1/hash-results/%s/missing-chunks", config.ApiEndpoint, config.Port, id)
+
+	resp, err := makeAuthenticatedRequest(config, jwt, "GET", url, nil, "identity")
+	if err != nil {
+		return nil, fmt.Errorf("failed to make authenticated request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list missing chunks of snapshot %s (status %d): %s", id, resp.StatusCode, string(body))
+	}
+
+	var missing missingChunks
+	if err := json.Unmarshal(body, &missing); err != nil {
+		return nil, fmt.Errorf("failed to decode missing chunks: %w", err)
+	}
+	return &missing, nil
+}
+
+// chunkClient transfers chunk contents of one hash result, zstd-compressed
+// where the controller supports it and it pays off. It is safe for
+// concurrent use.
+type chunkClient struct {
+	config   Config
+	jwt      *JWT
+	jwtMutex sync.Mutex // newAuthenticatedRequest may refresh the token
+	id       string
+	client   *http.Client
+	codec    *chunkCodec
+
+	compressUploads bool         // the controller accepts zstd uploads
+	sent            atomic.Int64 // bytes uploaded, as sent over the wire
+	received        atomic.Int64 // bytes downloaded, as received over the wire
+}
+
+// newChunkClient returns a client compressing at config's chunk_compression_level.
+func newChunkClient(config Config, jwt *JWT, id string) (*chunkClient, error) {
+	codec, err := newChunkCodec(config.ChunkCompressionLevel)
+	if err != nil {
+		return nil, fmt.Errorf("chunk_compression_level in config: %w", err)
+	}
+	return &chunkClient{config: config, jwt: jwt, id: id, client: &http.Client{}, codec: codec}, nil
+}
+
+// acceptEncodings enables compressed uploads if the controller lists zstd
+// among the encodings it accepts.
+func (c *chunkClient) acceptEncodings(encodings []string) {
+	c.compressUploads = c.codec.enabled() && slices.Contains(encodings, zstdEncoding)
+}
+
+func (c *chunkClient) do(ctx context.Context, method, hash string, body io.Reader, contentEncoding string) (*http.Response, error) {
+	url := fmt.Sprintf("http://%s:%d/api/v1/hash-results/%s/chunks/%s", c.config.ApiEndpoint, c.config.Port, c.id, hash)
+
+	c.jwtMutex.Lock()
+	req, err := newAuthenticatedRequest(c.config, c.jwt, method, url, body, "application/octet-stream", contentEncoding)
+	c.jwtMutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("error making authenticated request: %w", err)
+	}
+	if method == "GET" && c.codec.enabled() {
+		// Set explicitly, so the transport leaves the response body alone
+		req.Header.Set("Accept-Encoding", zstdEncoding)
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return resp, nil
+}
+
+// upload sends the content of a chunk. The controller decompresses it and
+// checks it against the digest before storing it.
+func (c *chunkClient) upload(ctx context.Context, hash string, data []byte) error {
+	body, encoding := data, "identity"
+	if c.compressUploads {
+		if compressed, ok := c.codec.compress(data); ok {
+			body, encoding = compressed, zstdEncoding
+		}
+	}
+	resp, err := c.do(ctx, "PUT", hash, bytes.NewReader(body), encoding)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	c.sent.Add(int64(len(body)))
 	return nil
 }
+
+// download fetches the content of a chunk pushed earlier and decompresses
+// it. The caller verifies it.
+func (c *chunkClient) download(ctx context.Context, hash string) ([]byte, error) {
+	resp, err := c.do(ctx, "GET", hash, nil, "identity")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxChunkTransferSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxChunkTransferSize {
+		return nil, fmt.Errorf("chunk is larger than %d bytes", maxChunkTransferSize)
+	}
+	c.received.Add(int64(len(body)))
+
+	switch encoding := resp.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+		return body, nil
+	case zstdEncoding:
+		data, err := c.codec.decompress(body)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing chunk: %w", err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// errCorruptChunks makes "cache fsck" exit with status 1 when it finds
+// damaged chunks.
+var errCorruptChunks = errors.New("corrupt chunks found")
+
+func handleCache(args []string, config Config, jwt *JWT) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: hiveforgectl cache [gc|fsck|stats] ...")
+	}
+
+	store, err := openChunkStore(config)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "gc":
+		return handleCacheGC(args[1:], store, config, jwt)
+	case "fsck":
+		return handleCacheFsck(args[1:], store)
+	case "stats":
+		return handleCacheStats(args[1:], store)
+	default:
+		return fmt.Errorf("unknown cache subcommand %q (expected gc, fsck or stats)", args[0])
+	}
+}
+
+// handleCacheGC evicts least recently used chunks above the size limit, or
+// with --unreferenced every chunk no --keep manifest refers to.
+func handleCacheGC(args []string, store *chunkStore, config Config, jwt *JWT) error {
+	fs := flag.NewFlagSet("cache gc", flag.ContinueOnError)
+	maxSize := fs.String("max-size", "", "Evict least recently used chunks above this size, e.g. 5G (default: cas_max_size from config)")
+	var keep stringList
+	fs.Var(&keep, "keep", "Never remove chunks of this manifest or snapshot:ID (repeatable)")
+	unreferenced := fs.Bool("unreferenced", false, "Remove every chunk not referenced by a --keep manifest")
+	dryRun := fs.Bool("dry-run", false, "Only report what would be removed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: hiveforgectl cache gc [--max-size SIZE] [--keep <manifest|snapshot:ID>]... [--unreferenced] [--dry-run]")
+	}
+	if *unreferenced && len(keep) == 0 {
+		return fmt.Errorf("--unreferenced needs at least one --keep manifest; without one it would empty the store")
+	}
+
+	opts := gcOptions{MaxSize: store.maxSize, Unreferenced: *unreferenced, DryRun: *dryRun}
+	if *maxSize != "" {
+		size, err := parseByteSize(*maxSize)
+		if err != nil {
+			return fmt.Errorf("invalid --max-size: %w", err)
+		}
+		opts.MaxSize = size
+	}
+	if len(keep) > 0 {
+		if jwt == nil {
+			jwt = &JWT{}
+		}
+		opts.Keep = make(map[string]bool)
+		for _, source := range keep {
+			manifest, err := loadManifest(source, config, jwt)
+			if err != nil {
+				return err
+			}
+			walkFiles(manifest.DirectoryStructure, func(h *FileHashes) {
+				for _, hash := range h.Hashes {
+					opts.Keep[hash] = true
+				}
+			})
+		}
+	}
+
+	result, err := store.collect(opts)
+	if err != nil {
+		return fmt.Errorf("error collecting %s: %w", store.dir, err)
+	}
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d chunks (%.2f MB); %d chunks (%.2f MB) remain in %s\n",
+		verb, result.removed, float64(result.removedSize)/1024/1024,
+		result.kept, float64(result.keptSize)/1024/1024, store.dir)
+	return nil
+}
+
+// handleCacheFsck checks every stored chunk against its digest.
+func handleCacheFsck(args []string, store *chunkStore) error {
+	fs := flag.NewFlagSet("cache fsck", flag.ContinueOnError)
+	remove := fs.Bool("delete", false, "Delete corrupt chunks and stray files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	result, err := store.fsck(*remove)
+	if err != nil {
+		return fmt.Errorf("error checking %s: %w", store.dir, err)
+	}
+	for _, chunk := range result.corrupt {
+		fmt.Printf("corrupt: %s\n", chunk.path)
+	}
+	for _, path := range result.stray {
+		fmt.Printf("stray: %s\n", path)
+	}
+	fmt.Printf("Checked %d chunks in %s: %d corrupt, %d stray files\n",
+		result.checked, store.dir, len(result.corrupt), len(result.stray))
+	if *remove && (len(result.corrupt) > 0 || len(result.stray) > 0) {
+		fmt.Println("Corrupt chunks and stray files were deleted (temporary files of writes in progress are kept)")
+	}
+	if len(result.corrupt) > 0 {
+		return errCorruptChunks
+	}
+	return nil
+}
+
+// handleCacheStats prints how much the store holds.
+func handleCacheStats(args []string, store *chunkStore) error {
+	if len(args) > 0 {
+		return fmt.Errorf("usage: hiveforgectl cache stats")
+	}
+	chunks, stray, err := store.list()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", store.dir, err)
+	}
+
+	type algorithmStats struct {
+		chunks int
+		size   int64
+	}
+	byAlgorithm := make(map[string]*algorithmStats)
+	var total int64
+	var oldest, newest time.Time
+	for _, chunk := range chunks {
+		stats := byAlgorithm[chunk.algorithm]
+		if stats == nil {
+			stats = &algorithmStats{}
+			byAlgorithm[chunk.algorithm] = stats
+		}
+		stats.chunks++
+		stats.size += chunk.size
+		total += chunk.size
+		if oldest.IsZero() || chunk.used.Before(oldest) {
+			oldest = chunk.used
+		}
+		if chunk.used.After(newest) {
+			newest = chunk.used
+		}
+	}
+
+	limit := "no limit"
+	if store.maxSize > 0 {
+		limit = fmt.Sprintf("limit %.2f MB", float64(store.maxSize)/1024/1024)
+	}
+	fmt.Printf("Chunk store: %s\n", store.dir)
+	fmt.Printf("Chunks:      %d (%.2f MB, %s)\n", len(chunks), float64(total)/1024/1024, limit)
+	algorithms := make([]string, 0, len(byAlgorithm))
+	for algorithm := range byAlgorithm {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+	for _, algorithm := range algorithms {
+		stats := byAlgorithm[algorithm]
+		fmt.Printf("  %-10s %d (%.2f MB)\n", algorithm, stats.chunks, float64(stats.size)/1024/1024)
+	}
+	if len(chunks) > 0 {
+		fmt.Printf("Used:        %s to %s\n", oldest.Format(time.DateTime), newest.Format(time.DateTime))
+	}
+	if len(stray) > 0 {
+		fmt.Printf("Stray files: %d (run cache fsck --delete to remove them)\n", len(stray))
+	}
+	return nil
+}
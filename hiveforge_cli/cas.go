@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultChunkStoreMaxSize = 10 << 30 // 10 GB
+	staleTempFileAge         = time.Hour
+)
+
+// chunkStore is a local content-addressed store of chunk bytes, so a chunk
+// is read from the sources or downloaded only once. Each chunk is a file
+// named by its digest: <dir>/<algorithm>/<first two hex digits>/<digest>.
+// A chunk's mtime records when it was last used, for LRU eviction.
+type chunkStore struct {
+	dir     string
+	maxSize int64 // enforceLimit evicts chunks above this many bytes; 0 for no limit
+}
+
+// defaultChunkStorePath returns ~/.hiveforge/cas.
+func defaultChunkStorePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".hiveforge", "cas"), nil
+}
+
+func newChunkStore(dir string) *chunkStore {
+	return &chunkStore{dir: dir}
+}
+
+// openChunkStore returns the store set up in config: cas_dir, by default
+// ~/.hiveforge/cas, limited to cas_max_size, by default 10G ("0" for no limit).
+func openChunkStore(config Config) (*chunkStore, error) {
+	dir := config.ChunkStoreDir
+	if dir == "" {
+		var err error
+		if dir, err = defaultChunkStorePath(); err != nil {
+			return nil, err
+		}
+	}
+	store := newChunkStore(dir)
+	store.maxSize = defaultChunkStoreMaxSize
+	if config.ChunkStoreMaxSize != "" {
+		size, err := parseByteSize(config.ChunkStoreMaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("cas_max_size in config: %w", err)
+		}
+		store.maxSize = size
+	}
+	return store, nil
+}
+
+func (s *chunkStore) path(algorithm, hash string) (string, error) {
+	if !isHexDigest(hash) {
+		return "", fmt.Errorf("invalid chunk digest %q", hash)
+	}
+	return filepath.Join(s.dir, algorithm, hash[:2], hash), nil
+}
+
+// get returns the stored bytes of a chunk, or false if it is not stored.
+// The caller verifies them.
+func (s *chunkStore) get(algorithm, hash string) ([]byte, bool) {
+	path, err := s.path(algorithm, hash)
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+// hasAll reports whether every one of the chunks is stored.
+func (s *chunkStore) hasAll(algorithm string, hashes []string) bool {
+	for _, hash := range hashes {
+		path, err := s.path(algorithm, hash)
+		if err != nil {
+			return false
+		}
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// put stores a chunk unless it is already there. The bytes are written to a
+// temporary file and renamed into place, so readers never see part of a chunk.
+func (s *chunkStore) put(algorithm, hash string, data []byte) error {
+	path, err := s.path(algorithm, hash)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// remove drops a chunk, e.g. a copy that failed verification.
+func (s *chunkStore) remove(algorithm, hash string) error {
+	path, err := s.path(algorithm, hash)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// storedChunk is a chunk file found in the store.
+type storedChunk struct {
+	algorithm string
+	hash      string
+	path      string
+	size      int64
+	used      time.Time
+}
+
+// list returns every chunk in the store, and stray files: temporary files
+// of interrupted writes and anything else that does not belong there.
+func (s *chunkStore) list() (chunks []storedChunk, stray []string, err error) {
+	err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == s.dir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll // nothing stored yet
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		name := d.Name()
+		if len(parts) != 3 || !isHexDigest(name) || parts[1] != name[:2] {
+			stray = append(stray, path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, storedChunk{algorithm: parts[0], hash: name, path: path, size: info.Size(), used: info.ModTime()})
+		return nil
+	})
+	return chunks, stray, err
+}
+
+// gcOptions selects what a garbage collection removes.
+type gcOptions struct {
+	MaxSize      int64           // evict the least recently used chunks above this many bytes; 0 for no limit
+	Keep         map[string]bool // digests that are never removed
+	Unreferenced bool            // remove every chunk not in Keep, whatever the size
+	DryRun       bool            // only report what would be removed
+}
+
+// gcResult counts what a garbage collection removed, or would remove.
+type gcResult struct {
+	kept, removed         int
+	keptSize, removedSize int64
+}
+
+// collect removes chunks as opts says, least recently used first, and
+// temporary files left behind by interrupted writes.
+func (s *chunkStore) collect(opts gcOptions) (gcResult, error) {
+	var result gcResult
+	chunks, stray, err := s.list()
+	if err != nil {
+		return result, err
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].used.Before(chunks[j].used) })
+
+	var total int64
+	for _, chunk := range chunks {
+		total += chunk.size
+	}
+	for _, chunk := range chunks {
+		evict := opts.Unreferenced || (opts.MaxSize > 0 && total > opts.MaxSize)
+		if !evict || opts.Keep[chunk.hash] {
+			result.kept++
+			result.keptSize += chunk.size
+			continue
+		}
+		if !opts.DryRun {
+			if err := os.Remove(chunk.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return result, err
+			}
+		}
+		total -= chunk.size
+		result.removed++
+		result.removedSize += chunk.size
+	}
+
+	if !opts.DryRun {
+		for _, path := range stray {
+			if isTempFile(path) && !writeInProgress(path) {
+				os.Remove(path)
+			}
+		}
+	}
+	return result, nil
+}
+
+// enforceLimit evicts the least recently used chunks once the store has
+// grown above its maximum size, and says so on out.
+func (s *chunkStore) enforceLimit(out io.Writer) error {
+	if s.maxSize <= 0 {
+		return nil
+	}
+	result, err := s.collect(gcOptions{MaxSize: s.maxSize})
+	if err != nil {
+		return fmt.Errorf("error trimming chunk store %s: %w", s.dir, err)
+	}
+	if result.removed > 0 {
+		fmt.Fprintf(out, "Chunk store: removed %d least recently used chunks (%.2f MB) to stay within %.2f MB\n",
+			result.removed, float64(result.removedSize)/1024/1024, float64(s.maxSize)/1024/1024)
+	}
+	return nil
+}
+
+// fsckResult lists what an integrity check of the store found.
+type fsckResult struct {
+	checked int
+	corrupt []storedChunk // content does not match the digest the file is named by
+	stray   []string
+}
+
+// fsck reads every chunk back and checks it against its digest. With
+// remove, corrupt chunks and stray files are deleted.
+func (s *chunkStore) fsck(remove bool) (fsckResult, error) {
+	var result fsckResult
+	chunks, stray, err := s.list()
+	if err != nil {
+		return result, err
+	}
+	result.stray = stray
+
+	for _, chunk := range chunks {
+		result.checked++
+		// Read directly: checking a chunk does not count as using it
+		data, err := os.ReadFile(chunk.path)
+		if err != nil {
+			return result, err
+		}
+		hasher, err := newHasher(chunk.algorithm)
+		if err != nil || sumHex(hasher, data) != chunk.hash {
+			result.corrupt = append(result.corrupt, chunk)
+		}
+	}
+
+	if remove {
+		for _, chunk := range result.corrupt {
+			if err := os.Remove(chunk.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return result, err
+			}
+		}
+		for _, path := range stray {
+			if writeInProgress(path) {
+				continue
+			}
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func isTempFile(path string) bool {
+	return strings.Contains(filepath.Base(path), ".tmp-")
+}
+
+// writeInProgress reports whether path is a recent temporary file, which
+// may still be written by put.
+func writeInProgress(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && isTempFile(path) && time.Since(info.ModTime()) < staleTempFileAge
+}
+
+// isHexDigest reports whether s is a lowercase hex digest, which makes it
+// safe to use as a file name.
+func isHexDigest(s string) bool {
+	if len(s) < 2 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
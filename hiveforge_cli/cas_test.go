@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// putChunks stores chunks of 100 bytes each, the first least recently used.
+func putChunks(t *testing.T, store *chunkStore, count int) []string {
+	var hashes []string
+	for i := 0; i < count; i++ {
+		data := testData(100 + i)[i : i+100]
+		hash := sumHex(blake3Hasher{}, data)
+		if err := store.put("blake3", hash, data); err != nil {
+			t.Fatal(err)
+		}
+		path, _ := store.path("blake3", hash)
+		used := time.Now().Add(time.Duration(i-count) * time.Minute)
+		if err := os.Chtimes(path, used, used); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func TestChunkStoreCollect(t *testing.T) {
+	store := newChunkStore(t.TempDir())
+	hashes := putChunks(t, store, 5)
+
+	// Using the oldest chunk makes it the most recently used
+	if data, ok := store.get("blake3", hashes[0]); !ok || sumHex(blake3Hasher{}, data) != hashes[0] {
+		t.Fatalf("get(%s) = %v, want the stored chunk", hashes[0], ok)
+	}
+	stale := filepath.Join(store.dir, "blake3", hashes[1][:2], hashes[1]+".tmp-1")
+	if err := os.WriteFile(stale, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleTempFileAge)
+	os.Chtimes(stale, old, old)
+
+	result, err := store.collect(gcOptions{MaxSize: 300, Keep: map[string]bool{hashes[1]: true}, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.removed != 2 || !store.hasAll("blake3", hashes) {
+		t.Fatalf("dry run removed %d chunks, want 2 reported and none deleted", result.removed)
+	}
+
+	if _, err := store.collect(gcOptions{MaxSize: 300, Keep: map[string]bool{hashes[1]: true}}); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, true, false, false, true} {
+		if got := store.hasAll("blake3", hashes[i:i+1]); got != want {
+			t.Errorf("chunk %d stored = %v after gc, want %v", i, got, want)
+		}
+	}
+	if _, err := os.Stat(stale); err == nil {
+		t.Errorf("stale temporary file %s was not removed", stale)
+	}
+
+	result, err = store.collect(gcOptions{Keep: map[string]bool{hashes[4]: true}, Unreferenced: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.kept != 1 || result.removed != 2 || !store.hasAll("blake3", hashes[4:]) {
+		t.Errorf("unreferenced gc kept %d and removed %d chunks, want 1 and 2", result.kept, result.removed)
+	}
+}
+
+func TestChunkStoreFsck(t *testing.T) {
+	store := newChunkStore(t.TempDir())
+	hashes := putChunks(t, store, 3)
+	path, _ := store.path("blake3", hashes[2])
+	if err := os.WriteFile(path, []byte("bit rot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(store.dir, "notes.txt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := store.fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.checked != 3 || len(result.corrupt) != 1 || result.corrupt[0].hash != hashes[2] || len(result.stray) != 1 {
+		t.Fatalf("fsck = %d checked, %v corrupt, %v stray; want 3, %s and notes.txt", result.checked, result.corrupt, result.stray, hashes[2])
+	}
+
+	if _, err := store.fsck(true); err != nil {
+		t.Fatal(err)
+	}
+	result, err = store.fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.checked != 2 || len(result.corrupt) != 0 || len(result.stray) != 0 {
+		t.Errorf("fsck after --delete = %d checked, %d corrupt, %d stray; want 2, 0, 0", result.checked, len(result.corrupt), len(result.stray))
+	}
+}
+
+func TestHashStoreChunksFeedsPush(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.bin"), testData(200*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newChunkStore(t.TempDir())
+	fixture := hashForPush(t, root, func(opts *HashOptions) { opts.Store = store })
+	if !store.hasAll("blake3", fixture.chunks) {
+		t.Fatal("hashing with a store did not keep every chunk")
+	}
+
+	// With the source gone, push still has every chunk
+	if err := os.Remove(filepath.Join(root, "a.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fixture.push(PushOptions{Jobs: 2, Progress: progressNone, Store: store}); err != nil {
+		t.Fatal(err)
+	}
+	if stored := len(fixture.controller.stored); stored != len(fixture.chunks) {
+		t.Errorf("pushed %d chunks from the store, want %d", stored, len(fixture.chunks))
+	}
+}
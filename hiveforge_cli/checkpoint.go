@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const checkpointDir = "checkpoints"
+
+// checkpointPath returns where an interrupted hash of rootPath leaves the
+// files it already finished: ~/.hiveforge/checkpoints/<digest of the path>.json.
+func checkpointPath(rootPath string) (string, error) {
+	root, err := filepath.Abs(rootPath)
+	if err != nil {
+		return "", err
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	name := sumHex(sha256Hasher{}, []byte(root))[:32] + ".json"
+	return filepath.Join(home, ".hiveforge", checkpointDir, name), nil
+}
+
+// loadCheckpoint adds the files recorded in a checkpoint to the cache and
+// returns how many there were. They are validated like any cache entry, so a
+// file changed since the interruption is hashed again.
+func (c *hashCache) loadCheckpoint(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var entries map[string]hashCacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, fmt.Errorf("unreadable checkpoint %s: %w", path, err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, entry := range entries {
+		c.entries[key] = entry
+		// Kept in the next checkpoint even if this run is interrupted before
+		// reaching them
+		c.touched[key] = true
+	}
+	return len(entries), nil
+}
+
+// saveCheckpoint writes the entries under rootPath seen in this run and
+// returns how many there were. Files modified within hashCacheRacyWindow of
+// being hashed are left out, as from the cache.
+func (c *hashCache) saveCheckpoint(path string, rootPath string) (int, error) {
+	root, err := filepath.Abs(rootPath)
+	if err != nil {
+		return 0, err
+	}
+	prefix := root + string(filepath.Separator)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entries := make(map[string]hashCacheEntry)
+	for key, entry := range c.entries {
+		if strings.HasPrefix(key, prefix) && c.touched[key] {
+			entries[key] = entry
+		}
+	}
+	return len(entries), writeHashCacheFile(path, entries)
+}
+
+// contextReader stops reading once ctx is cancelled, so an interrupt does not
+// have to wait for a large file to be hashed to the end.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
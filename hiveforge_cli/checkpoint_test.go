@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "a.bin")
+	if err := os.WriteFile(path, []byte("checkpointed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Outside the racy window, so the file is remembered
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := ChunkingParams{Scheme: chunkingFixed}
+	hashes, err := hashFile(context.Background(), path, params, blake3Hasher{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newHashCache("")
+	cache.store(path, info, params, blake3Hasher{}, hashes)
+
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	if saved, err := cache.saveCheckpoint(checkpoint, root); err != nil || saved != 1 {
+		t.Fatalf("saveCheckpoint = %d, %v; want 1 file", saved, err)
+	}
+
+	resumed := newHashCache("")
+	if count, err := resumed.loadCheckpoint(checkpoint); err != nil || count != 1 {
+		t.Fatalf("loadCheckpoint = %d, %v; want 1 file", count, err)
+	}
+	got, hit := resumed.lookup(path, info, params, blake3Hasher{})
+	if !hit || got.Digest != hashes.Digest {
+		t.Errorf("lookup after resume = %v, %v; want the checkpointed hashes", got.Digest, hit)
+	}
+}
+
+func TestHashDirectoryCancelled(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := hashDirectory(ctx, root, HashOptions{
+		Chunking: ChunkingParams{Scheme: chunkingFixed},
+		Hasher:   blake3Hasher{},
+		Jobs:     1,
+		NoCache:  true,
+		Symlinks: symlinksFollow,
+		Progress: progressNone,
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("hashDirectory with a cancelled context returned %v, want context.Canceled", err)
+	}
+	checkpoint, err := checkpointPath(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(checkpoint); err != nil {
+		t.Errorf("no checkpoint written: %v", err)
+	}
+}
+
+func TestCheckpointSurvivesOtherRuns(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := HashOptions{
+		Chunking: ChunkingParams{Scheme: chunkingFixed},
+		Hasher:   blake3Hasher{},
+		Jobs:     1,
+		Symlinks: symlinksFollow,
+		Progress: progressNone,
+	}
+	manifest, err := hashDirectory(context.Background(), root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(t.TempDir(), "m.json")
+	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := hashDirectory(ctx, root, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted hash returned %v, want context.Canceled", err)
+	}
+	checkpoint, err := checkpointPath(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stdout, stderr, status := runCLI(t, "verify", "--quiet", root, manifestPath); status != 0 {
+		t.Fatalf("verify exited with %d:\n%s%s", status, stdout, stderr)
+	}
+	sha256Opts := opts
+	sha256Opts.Hasher = sha256Hasher{}
+	if _, err := hashDirectory(context.Background(), root, sha256Opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(checkpoint); err != nil {
+		t.Fatalf("checkpoint gone after verify and a sha256 hash: %v", err)
+	}
+
+	var out bytes.Buffer
+	opts.Resume = true
+	opts.Output = &out
+	if _, err := hashDirectory(context.Background(), root, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Resuming from checkpoint") {
+		t.Errorf("--resume output %q, want it to resume from the checkpoint", out.String())
+	}
+	if _, err := os.Stat(checkpoint); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("checkpoint left after the resumed run finished: %v", err)
+	}
+}
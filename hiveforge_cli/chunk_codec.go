@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	zstdEncoding = "zstd"
+	// Largest chunk the controller accepts; also bounds decompression
+	maxChunkTransferSize = 64_000_000
+	// defaultZstdLevel is zstd's own default, a good trade-off for source trees
+	defaultZstdLevel = 3
+)
+
+// chunkCodec compresses chunk contents for transfer. Digests are always taken
+// over the uncompressed bytes, so compression does not affect deduplication.
+// It is safe for concurrent use.
+type chunkCodec struct {
+	encoder *zstd.Encoder // nil if compression is turned off
+	decoder *zstd.Decoder
+}
+
+// newChunkCodec returns a codec compressing at a zstd level from 1 to 22,
+// 0 for the default, or not at all for a negative level.
+func newChunkCodec(level int) (*chunkCodec, error) {
+	if level < 0 {
+		return &chunkCodec{}, nil
+	}
+	if level == 0 {
+		level = defaultZstdLevel
+	}
+	if level > 22 {
+		return nil, fmt.Errorf("zstd level %d is out of range 1-22", level)
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxChunkTransferSize), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &chunkCodec{encoder: encoder, decoder: decoder}, nil
+}
+
+func (c *chunkCodec) enabled() bool {
+	return c.encoder != nil
+}
+
+// compress returns the zstd-compressed chunk, or false if compressing does
+// not save at least 1/32 of its size: already compressed data, media and
+// small chunks are sent as they are.
+func (c *chunkCodec) compress(data []byte) ([]byte, bool) {
+	if c.encoder == nil || len(data) < 64 {
+		return nil, false
+	}
+	compressed := c.encoder.EncodeAll(data, make([]byte, 0, len(data)))
+	if len(compressed) > len(data)-len(data)/32 {
+		return nil, false
+	}
+	return compressed, true
+}
+
+// decompress undoes compress.
+func (c *chunkCodec) decompress(data []byte) ([]byte, error) {
+	if c.decoder == nil {
+		return nil, fmt.Errorf("received a zstd chunk with compression turned off")
+	}
+	return c.decoder.DecodeAll(data, nil)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChunkCodec(t *testing.T) {
+	codec, err := newChunkCodec(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := []byte(strings.Repeat("func main() {\n\tfmt.Println(\"hello\")\n}\n", 1000))
+	compressed, ok := codec.compress(text)
+	if !ok || len(compressed) >= len(text)/10 {
+		t.Fatalf("compress(text) = %d bytes, %v; want well under %d", len(compressed), ok, len(text)/10)
+	}
+	data, err := codec.decompress(compressed)
+	if err != nil || !bytes.Equal(data, text) {
+		t.Fatalf("decompress = %d bytes, %v; want the original %d bytes", len(data), err, len(text))
+	}
+
+	if _, ok := codec.compress(testData(64 * 1024)); ok {
+		t.Error("random data was compressed, want it sent as is")
+	}
+
+	off, err := newChunkCodec(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := off.compress(text); ok || off.enabled() {
+		t.Error("a negative level still compresses")
+	}
+	if _, err := newChunkCodec(23); err == nil {
+		t.Error("level 23 was accepted")
+	}
+}
+
+func TestChunkTransferCompression(t *testing.T) {
+	root := t.TempDir()
+	text := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 4000))
+	if err := os.WriteFile(filepath.Join(root, "notes.txt"), text, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "random.bin"), testData(100*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := hashForPush(t, root, nil)
+	controller := fixture.controller
+	if err := fixture.push(PushOptions{Jobs: 2, Progress: progressNone}); err != nil {
+		t.Fatal(err)
+	}
+	// Stored under the digest of the uncompressed bytes
+	for _, hash := range fixture.chunks {
+		if sumHex(blake3Hasher{}, controller.stored[hash]) != hash {
+			t.Fatalf("chunk %s was not stored uncompressed", hash)
+		}
+	}
+	if controller.compressed == 0 || controller.compressed == len(controller.stored) {
+		t.Errorf("%d of %d chunks were uploaded compressed, want the text chunks only", controller.compressed, len(controller.stored))
+	}
+
+	client, err := newChunkClient(fixture.config, fixture.jwt, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.compressed = 0
+	dest := filepath.Join(t.TempDir(), "restored")
+	if err := restoreSnapshot(context.Background(), fixture.manifest, client, dest, RestoreOptions{Jobs: 2, Progress: progressNone}); err != nil {
+		t.Fatal(err)
+	}
+	if controller.compressed == 0 || client.received.Load() >= int64(len(text)) {
+		t.Errorf("restore received %d bytes with %d compressed chunks, want compressed text", client.received.Load(), controller.compressed)
+	}
+	restored, err := os.ReadFile(filepath.Join(dest, "notes.txt"))
+	if err != nil || !bytes.Equal(restored, text) {
+		t.Errorf("restored notes.txt differs: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	chunkingFixed   = "fixed"
+	chunkingFastCDC = "fastcdc"
+
+	defaultCDCMinSize = minChunkSize // 64 KB
+	defaultCDCAvgSize = 256 * 1024   // 256 KB
+	defaultCDCMaxSize = maxChunkSize // 1 MB
+)
+
+// chunker splits a stream into chunks. The slice returned by Next is only
+// valid until the following call; io.EOF is returned once the stream is drained.
+type chunker interface {
+	Next() ([]byte, error)
+}
+
+func defaultChunkingParams(scheme string) (ChunkingParams, error) {
+	switch scheme {
+	case chunkingFixed:
+		return ChunkingParams{Scheme: chunkingFixed}, nil
+	case chunkingFastCDC, "cdc":
+		return ChunkingParams{
+			Scheme:  chunkingFastCDC,
+			MinSize: defaultCDCMinSize,
+			AvgSize: defaultCDCAvgSize,
+			MaxSize: defaultCDCMaxSize,
+		}, nil
+	default:
+		return ChunkingParams{}, fmt.Errorf("unknown chunking scheme %q (expected %s or %s)", scheme, chunkingFixed, chunkingFastCDC)
+	}
+}
+
+func (p ChunkingParams) validate() error {
+	if p.Scheme != chunkingFastCDC {
+		return nil
+	}
+	if p.MinSize <= 0 || p.AvgSize <= p.MinSize || p.MaxSize <= p.AvgSize {
+		return fmt.Errorf("invalid chunk sizes: need 0 < min < avg < max, got %d/%d/%d", p.MinSize, p.AvgSize, p.MaxSize)
+	}
+	// Below 8 the large mask of newCDCChunker is empty and every byte past
+	// min would end a chunk
+	if p.AvgSize < 8 {
+		return fmt.Errorf("invalid average chunk size %d: must be at least 8 bytes", p.AvgSize)
+	}
+	// Every worker buffers a whole chunk, and the controller refuses larger ones
+	if p.MaxSize > maxChunkTransferSize {
+		return fmt.Errorf("invalid maximum chunk size %d: must be at most %d bytes", p.MaxSize, maxChunkTransferSize)
+	}
+	return nil
+}
+
+func newChunker(r io.Reader, params ChunkingParams, fileSize int64) chunker {
+	if params.Scheme == chunkingFastCDC {
+		return newCDCChunker(r, params)
+	}
+	return &fixedChunker{r: r, buf: make([]byte, calculateChunkSize(fileSize))}
+}
+
+// chunkSpan is where a chunk lies within its file.
+type chunkSpan struct {
+	offset int64
+	size   int64
+}
+
+// fileChunkSpans locates every chunk of a manifest file entry, from the sizes
+// recorded for content-defined chunks or else from the fixed chunk size.
+func fileChunkSpans(h *FileHashes) ([]chunkSpan, error) {
+	spans := make([]chunkSpan, len(h.Hashes))
+	var offset int64
+	for i := range h.Hashes {
+		var size int64
+		switch {
+		case len(h.ChunkSizes) == len(h.Hashes):
+			size = int64(h.ChunkSizes[i])
+		case h.ChunkSize > 0:
+			size = min(int64(h.ChunkSize), h.TotalSize-offset)
+		default:
+			return nil, fmt.Errorf("manifest records no chunk sizes")
+		}
+		if size <= 0 {
+			return nil, fmt.Errorf("chunk %d lies beyond the file size of %d bytes", i, h.TotalSize)
+		}
+		spans[i] = chunkSpan{offset: offset, size: size}
+		offset += size
+	}
+	if offset != h.TotalSize {
+		return nil, fmt.Errorf("chunks add up to %d bytes, the file has %d", offset, h.TotalSize)
+	}
+	return spans, nil
+}
+
+type fixedChunker struct {
+	r   io.Reader
+	buf []byte
+}
+
+// Next always fills a whole chunk unless the stream ends first. A bare Read
+// may return fewer bytes (NFS, FUSE, pipes), which would move the boundary.
+func (c *fixedChunker) Next() ([]byte, error) {
+	n, err := io.ReadFull(c.r, c.buf)
+	if err == io.ErrUnexpectedEOF {
+		return c.buf[:n], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.buf[:n], nil
+}
+
+// cdcChunker implements FastCDC with normalized chunking: below the average
+// size a stricter mask is used, above it a looser one, which keeps chunk sizes
+// close to the average while boundaries still depend only on content.
+type cdcChunker struct {
+	r      io.Reader
+	params ChunkingParams
+	maskS  uint64
+	maskL  uint64
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+func newCDCChunker(r io.Reader, params ChunkingParams) *cdcChunker {
+	avgBits := bits.Len(uint(params.AvgSize)) - 1
+	return &cdcChunker{
+		r:      r,
+		params: params,
+		maskS:  gearMask(avgBits + 2),
+		maskL:  gearMask(avgBits - 2),
+		buf:    make([]byte, params.MaxSize),
+	}
+}
+
+func (c *cdcChunker) Next() ([]byte, error) {
+	if !c.eof && c.end-c.start < c.params.MaxSize {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the length of the next chunk at the start of data.
+func (c *cdcChunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.params.MinSize {
+		return n
+	}
+	if n > c.params.MaxSize {
+		n = c.params.MaxSize
+	}
+	normal := c.params.AvgSize
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.params.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// gearMask selects the top n bits of the rolling hash; those depend on the
+// whole 64-byte window rather than only the last few bytes.
+func gearMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	if n >= 64 {
+		return ^uint64(0)
+	}
+	return ((uint64(1) << n) - 1) << (64 - n)
+}
+
+// gearTable is derived from a fixed seed so every client cuts identical
+// boundaries. Changing the seed or generator invalidates all stored chunks.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6869766566726765) // ASCII "hiveforg"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
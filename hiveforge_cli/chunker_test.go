@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/iotest"
+
+	"github.com/zeebo/blake3"
+)
+
+// shortReader returns a pseudo-random number of bytes per Read, like a
+// network filesystem or pipe might.
+type shortReader struct {
+	r   io.Reader
+	rng *rand.Rand
+}
+
+func (s *shortReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1+s.rng.Intn(len(p)-1)]
+	}
+	return s.r.Read(p)
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(42)).Read(data)
+	return data
+}
+
+func testChunkingParams() map[string]ChunkingParams {
+	return map[string]ChunkingParams{
+		"fixed": {Scheme: chunkingFixed},
+		"fastcdc": {
+			Scheme:  chunkingFastCDC,
+			MinSize: 2 * 1024,
+			AvgSize: 8 * 1024,
+			MaxSize: 32 * 1024,
+		},
+	}
+}
+
+func TestHashReaderIgnoresReadSizes(t *testing.T) {
+	data := testData(512*1024 + 123)
+
+	readers := map[string]func() io.Reader{
+		"one byte": func() io.Reader { return iotest.OneByteReader(bytes.NewReader(data)) },
+		"half":     func() io.Reader { return iotest.HalfReader(bytes.NewReader(data)) },
+		"data+err": func() io.Reader { return iotest.DataErrReader(bytes.NewReader(data)) },
+		"random": func() io.Reader {
+			return &shortReader{r: bytes.NewReader(data), rng: rand.New(rand.NewSource(7))}
+		},
+	}
+
+	for scheme, params := range testChunkingParams() {
+		want, err := hashReader(bytes.NewReader(data), "data", int64(len(data)), params, blake3Hasher{}, nil)
+		if err != nil {
+			t.Fatalf("%s: hashing full reads: %v", scheme, err)
+		}
+		if want.ChunkCount < 2 {
+			t.Fatalf("%s: expected several chunks, got %d", scheme, want.ChunkCount)
+		}
+
+		for name, newReader := range readers {
+			got, err := hashReader(newReader(), "data", int64(len(data)), params, blake3Hasher{}, nil)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", scheme, name, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s/%s: chunk list differs from full reads (%d vs %d chunks)",
+					scheme, name, got.ChunkCount, want.ChunkCount)
+			}
+		}
+	}
+}
+
+func TestFixedChunksAreFullSize(t *testing.T) {
+	data := testData(3*minChunkSize + 10)
+	chunks := newChunker(iotest.OneByteReader(bytes.NewReader(data)), ChunkingParams{Scheme: chunkingFixed}, int64(len(data)))
+
+	var sizes []int
+	for {
+		chunk, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(chunk))
+	}
+
+	want := []int{minChunkSize, minChunkSize, minChunkSize, 10}
+	if !reflect.DeepEqual(sizes, want) {
+		t.Errorf("chunk sizes = %v, want %v", sizes, want)
+	}
+}
+
+func TestCDCChunkSizesWithinBounds(t *testing.T) {
+	params := testChunkingParams()["fastcdc"]
+	data := testData(1024 * 1024)
+
+	result, err := hashReader(&shortReader{r: bytes.NewReader(data), rng: rand.New(rand.NewSource(1))}, "data", int64(len(data)), params, blake3Hasher{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for i, size := range result.ChunkSizes {
+		last := i == len(result.ChunkSizes)-1
+		if size > params.MaxSize || (!last && size < params.MinSize) {
+			t.Errorf("chunk %d has size %d outside [%d, %d]", i, size, params.MinSize, params.MaxSize)
+		}
+		total += size
+	}
+	if total != len(data) {
+		t.Errorf("chunk sizes add up to %d, want %d", total, len(data))
+	}
+}
+
+func TestWholeFileDigestIgnoresChunking(t *testing.T) {
+	data := testData(16 * 1024 * 1024)
+	sum := blake3.Sum256(data)
+	want := hex.EncodeToString(sum[:])
+
+	larger := testChunkingParams()["fastcdc"]
+	larger.MinSize, larger.AvgSize, larger.MaxSize = 16*1024, 64*1024, 256*1024
+	for name, params := range map[string]ChunkingParams{
+		"fixed":          testChunkingParams()["fixed"],
+		"fastcdc":        testChunkingParams()["fastcdc"],
+		"fastcdc 64 KiB": larger,
+	} {
+		result, err := hashReader(bytes.NewReader(data), "data", int64(len(data)), params, blake3Hasher{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Digest != want {
+			t.Errorf("%s: digest over %d chunks = %s, want %s", name, len(result.Hashes), result.Digest, want)
+		}
+	}
+}
+
+func TestWholeFileDigestBeyondTargetChunks(t *testing.T) {
+	// Fixed chunks only outnumber targetChunks once they stop growing at
+	// maxChunkSize, past 1 GiB
+	sizes := map[string]int64{
+		"fixed":   targetChunks*maxChunkSize + 1,
+		"fastcdc": 16 * 1024 * 1024,
+	}
+	for scheme, params := range testChunkingParams() {
+		size := sizes[scheme]
+		if testing.Short() && size > 1<<30 {
+			continue
+		}
+		whole := blake3.New()
+		r := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(7)), size), whole)
+		result, err := hashReader(r, "data", size, params, blake3Hasher{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Hashes) <= targetChunks {
+			t.Fatalf("%s: %d chunks, want more than %d", scheme, len(result.Hashes), targetChunks)
+		}
+		if want := hex.EncodeToString(whole.Sum(nil)); result.Digest != want {
+			t.Errorf("%s: digest = %s, want %s", scheme, result.Digest, want)
+		}
+	}
+}
+
+func TestHashReaderPropagatesErrors(t *testing.T) {
+	readErr := errors.New("stale NFS file handle")
+
+	for scheme, params := range testChunkingParams() {
+		r := io.MultiReader(bytes.NewReader(testData(1000)), iotest.ErrReader(readErr))
+		if _, err := hashReader(r, "data", 4096, params, blake3Hasher{}, nil); !errors.Is(err, readErr) {
+			t.Errorf("%s: got error %v, want %v", scheme, err, readErr)
+		}
+	}
+}
+
+func TestChunkingParamsValidate(t *testing.T) {
+	tests := []struct {
+		params ChunkingParams
+		valid  bool
+	}{
+		{testChunkingParams()["fastcdc"], true},
+		{ChunkingParams{Scheme: chunkingFastCDC, MinSize: 2, AvgSize: 8, MaxSize: 16}, true},
+		{ChunkingParams{Scheme: chunkingFastCDC, MinSize: 0, AvgSize: 8, MaxSize: 16}, false},
+		{ChunkingParams{Scheme: chunkingFastCDC, MinSize: 8, AvgSize: 8, MaxSize: 16}, false},
+		{ChunkingParams{Scheme: chunkingFastCDC, MinSize: 2, AvgSize: 4, MaxSize: 16}, false},
+		{ChunkingParams{Scheme: chunkingFastCDC, MinSize: 1 << 20, AvgSize: 4 << 20, MaxSize: maxChunkTransferSize}, true},
+		{ChunkingParams{Scheme: chunkingFastCDC, MinSize: 1 << 20, AvgSize: 4 << 20, MaxSize: maxChunkTransferSize + 1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.params.validate(); (err == nil) != tt.valid {
+			t.Errorf("validate(%d/%d/%d) = %v, want valid %v", tt.params.MinSize, tt.params.AvgSize, tt.params.MaxSize, err, tt.valid)
+		}
+	}
+}
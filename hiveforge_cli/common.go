@@ -2,17 +2,17 @@ package main
 
 import (
 	"encoding/base64"
-	"github.com/zeebo/blake3"
 	"encoding/hex"
 )
 
+// The controller verifies key hashes and challenge responses with BLAKE3,
+// independent of the algorithm chosen for manifests.
+var authHasher Hasher = blake3Hasher{}
+
 func hashKey(key string) string {
-	hash := blake3.Sum256([]byte(key))
-	return base64.StdEncoding.EncodeToString(hash[:])
+	return base64.StdEncoding.EncodeToString(sumBytes(authHasher, []byte(key)))
 }
 
-
 func solveChallenge(challenge, key string) string {
-	hash := blake3.Sum256([]byte(challenge + key))
-	return hex.EncodeToString(hash[:])
+	return hex.EncodeToString(sumBytes(authHasher, []byte(challenge+key)))
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+type diffReport struct {
+	Old     string           `json:"old"`
+	New     string           `json:"new"`
+	Changes []diffFileReport `json:"changes"`
+	Summary diffSummary      `json:"summary"`
+}
+
+type diffFileReport struct {
+	Path          string  `json:"path"`
+	Kind          string  `json:"kind"`
+	OldSize       int64   `json:"oldSize,omitempty"`
+	NewSize       int64   `json:"newSize,omitempty"`
+	OldMode       uint32  `json:"oldMode,omitempty"`
+	NewMode       uint32  `json:"newMode,omitempty"`
+	ChunksChanged int     `json:"chunksChanged,omitempty"`
+	ChunksTotal   int     `json:"chunksTotal,omitempty"`
+	ChangedPct    float64 `json:"changedPercent,omitempty"` // share of the new file's bytes in changed chunks
+}
+
+type diffSummary struct {
+	Added            int     `json:"added"`
+	Removed          int     `json:"removed"`
+	Modified         int     `json:"modified"`
+	ModeChanged      int     `json:"modeChanged"`
+	ChunksComparable bool    `json:"chunksComparable"` // false if algorithm or chunking differ
+	NewUniqueChunks  int     `json:"newUniqueChunks"`
+	NewUniqueBytes   int64   `json:"newUniqueBytes"` // bytes that would have to be uploaded
+	NewTotalBytes    int64   `json:"newTotalBytes"`
+	ChangedPct       float64 `json:"changedPercent"`
+}
+
+func handleDiff(args []string, config Config, jwt *JWT) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	format := fs.String("format", "text", "Output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 || (*format != "text" && *format != "json") {
+		return fmt.Errorf("usage: hiveforgectl diff [--format text|json] <old.json|snapshot:ID> <new.json|snapshot:ID>")
+	}
+	if jwt == nil {
+		jwt = &JWT{}
+	}
+
+	oldManifest, err := loadManifest(fs.Arg(0), config, jwt)
+	if err != nil {
+		return err
+	}
+	newManifest, err := loadManifest(fs.Arg(1), config, jwt)
+	if err != nil {
+		return err
+	}
+
+	report := buildDiffReport(oldManifest, newManifest)
+	report.Old, report.New = fs.Arg(0), fs.Arg(1)
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	printDiffReport(report)
+	return nil
+}
+
+func buildDiffReport(oldManifest, newManifest *DirectoryHashResult) diffReport {
+	report := diffReport{Changes: []diffFileReport{}}
+	summary := &report.Summary
+	summary.ChunksComparable = oldManifest.Algorithm == newManifest.Algorithm &&
+		oldManifest.Chunking == newManifest.Chunking
+
+	for _, change := range diffTrees(oldManifest.DirectoryStructure, newManifest.DirectoryStructure) {
+		file := diffFileReport{Path: change.Path, Kind: change.Kind}
+		if change.Old != nil {
+			file.OldSize, file.OldMode = change.Old.Size, change.Old.Mode
+		}
+		if change.New != nil {
+			file.NewSize, file.NewMode = change.New.Size, change.New.Mode
+		}
+
+		switch change.Kind {
+		case changeAdded:
+			summary.Added++
+			if change.New.Hashes != nil {
+				file.ChunksTotal = len(change.New.Hashes.Hashes)
+				file.ChunksChanged = file.ChunksTotal
+				// As for modified files, an empty file has no share of changed bytes
+				if change.New.Hashes.TotalSize > 0 {
+					file.ChangedPct = 100
+				}
+			}
+		case changeRemoved:
+			summary.Removed++
+		case changeModified:
+			summary.Modified++
+			if summary.ChunksComparable && change.Old.Hashes != nil && change.New.Hashes != nil {
+				file.ChunksChanged, file.ChunksTotal, file.ChangedPct = chunkChanges(change.Old.Hashes, change.New.Hashes)
+			}
+		case changeMode:
+			summary.ModeChanged++
+		}
+		report.Changes = append(report.Changes, file)
+	}
+
+	// Count each chunk of the new tree once, however many files share it
+	oldChunks := make(map[string]bool)
+	if summary.ChunksComparable {
+		walkFiles(oldManifest.DirectoryStructure, func(hashes *FileHashes) {
+			for _, hash := range hashes.Hashes {
+				oldChunks[hash] = true
+			}
+		})
+	}
+	seen := make(map[string]bool)
+	walkFiles(newManifest.DirectoryStructure, func(hashes *FileHashes) {
+		summary.NewTotalBytes += hashes.TotalSize
+		for i, size := range chunkSizes(hashes) {
+			hash := hashes.Hashes[i]
+			if oldChunks[hash] || seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			summary.NewUniqueChunks++
+			summary.NewUniqueBytes += size
+		}
+	})
+	if summary.NewTotalBytes > 0 {
+		summary.ChangedPct = float64(summary.NewUniqueBytes) / float64(summary.NewTotalBytes) * 100
+	}
+
+	return report
+}
+
+// chunkChanges counts the chunks of newHashes that do not occur in oldHashes
+// and the share of the new file's bytes they cover.
+func chunkChanges(oldHashes, newHashes *FileHashes) (changed, total int, pct float64) {
+	oldSet := make(map[string]bool, len(oldHashes.Hashes))
+	for _, hash := range oldHashes.Hashes {
+		oldSet[hash] = true
+	}
+
+	var changedBytes int64
+	for i, size := range chunkSizes(newHashes) {
+		if !oldSet[newHashes.Hashes[i]] {
+			changed++
+			changedBytes += size
+		}
+	}
+	total = len(newHashes.Hashes)
+	if newHashes.TotalSize > 0 {
+		pct = float64(changedBytes) / float64(newHashes.TotalSize) * 100
+	}
+	return changed, total, pct
+}
+
+// walkFiles calls fn for every hashed file below entry.
+func walkFiles(entry *DirectoryEntry, fn func(*FileHashes)) {
+	if entry.Hashes != nil {
+		fn(entry.Hashes)
+	}
+	for _, child := range entry.Children {
+		walkFiles(child, fn)
+	}
+}
+
+func printDiffReport(report diffReport) {
+	for _, file := range report.Changes {
+		switch file.Kind {
+		case changeAdded:
+			fmt.Printf("A  %s\n", file.Path)
+		case changeRemoved:
+			fmt.Printf("D  %s\n", file.Path)
+		case changeModified:
+			if file.ChunksTotal > 0 {
+				fmt.Printf("M  %s (%d/%d chunks changed, %.1f%%)\n", file.Path, file.ChunksChanged, file.ChunksTotal, file.ChangedPct)
+			} else {
+				fmt.Printf("M  %s\n", file.Path)
+			}
+		case changeMode:
+			fmt.Printf("m  %s (%04o -> %04o)\n", file.Path, file.OldMode, file.NewMode)
+		}
+	}
+
+	summary := report.Summary
+	fmt.Printf("\n%d added, %d removed, %d modified, %d mode changed\n",
+		summary.Added, summary.Removed, summary.Modified, summary.ModeChanged)
+	if !summary.ChunksComparable {
+		fmt.Println("Note: manifests use different algorithms or chunking; every chunk counts as new")
+	}
+	fmt.Printf("New unique chunks: %d (%.2f MB, %.1f%% of %.2f MB)\n",
+		summary.NewUniqueChunks,
+		float64(summary.NewUniqueBytes)/1024/1024,
+		summary.ChangedPct,
+		float64(summary.NewTotalBytes)/1024/1024,
+	)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// diffChunkSizes are the sizes of the chunks used by diffTestFile.
+var diffChunkSizes = map[string]int{"a": 100, "b": 200, "c": 300, "d": 400}
+
+// diffTestFile is a file made of the named chunks.
+func diffTestFile(name string, chunks ...string) *DirectoryEntry {
+	hashes := &FileHashes{Chunking: chunkingFastCDC, Digest: "file:" + strings.Join(chunks, ""), Hashes: chunks}
+	for _, chunk := range chunks {
+		hashes.ChunkSizes = append(hashes.ChunkSizes, diffChunkSizes[chunk])
+		hashes.TotalSize += int64(diffChunkSizes[chunk])
+	}
+	return &DirectoryEntry{Name: name, Type: "file", Size: hashes.TotalSize, Mode: 0644, Hashes: hashes}
+}
+
+func diffTestManifest(algorithm string, files ...*DirectoryEntry) *DirectoryHashResult {
+	for _, file := range files {
+		file.Hashes.Algorithm = algorithm
+	}
+	return &DirectoryHashResult{
+		Algorithm:          algorithm,
+		Chunking:           testChunkingParams()["fastcdc"],
+		DirectoryStructure: &DirectoryEntry{Type: "directory", Children: files},
+	}
+}
+
+func TestBuildDiffReport(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new *DirectoryHashResult
+		changes  []diffFileReport
+		summary  diffSummary
+	}{
+		{
+			name:    "identical",
+			old:     diffTestManifest("blake3", diffTestFile("f", "a", "b"), diffTestFile("empty")),
+			new:     diffTestManifest("blake3", diffTestFile("f", "a", "b"), diffTestFile("empty")),
+			changes: []diffFileReport{},
+			summary: diffSummary{ChunksComparable: true, NewTotalBytes: 300},
+		},
+		{
+			name: "one chunk of two changed",
+			old:  diffTestManifest("blake3", diffTestFile("f", "a", "b")),
+			new:  diffTestManifest("blake3", diffTestFile("f", "a", "c")),
+			changes: []diffFileReport{
+				{Path: "f", Kind: changeModified, OldSize: 300, NewSize: 400, OldMode: 0644, NewMode: 0644, ChunksChanged: 1, ChunksTotal: 2, ChangedPct: 75},
+			},
+			summary: diffSummary{Modified: 1, ChunksComparable: true, NewUniqueChunks: 1, NewUniqueBytes: 300, NewTotalBytes: 400, ChangedPct: 75},
+		},
+		{
+			name: "added files share new chunks",
+			old:  diffTestManifest("blake3", diffTestFile("f", "a", "b")),
+			new:  diffTestManifest("blake3", diffTestFile("f", "a", "b"), diffTestFile("g", "a", "d"), diffTestFile("h", "d", "d"), diffTestFile("empty")),
+			changes: []diffFileReport{
+				{Path: "empty", Kind: changeAdded, NewMode: 0644},
+				{Path: "g", Kind: changeAdded, NewSize: 500, NewMode: 0644, ChunksChanged: 2, ChunksTotal: 2, ChangedPct: 100},
+				{Path: "h", Kind: changeAdded, NewSize: 800, NewMode: 0644, ChunksChanged: 2, ChunksTotal: 2, ChangedPct: 100},
+			},
+			summary: diffSummary{Added: 3, ChunksComparable: true, NewUniqueChunks: 1, NewUniqueBytes: 400, NewTotalBytes: 1600, ChangedPct: 25},
+		},
+		{
+			name: "emptied file",
+			old:  diffTestManifest("blake3", diffTestFile("f", "a", "b")),
+			new:  diffTestManifest("blake3", diffTestFile("f")),
+			changes: []diffFileReport{
+				{Path: "f", Kind: changeModified, OldSize: 300, OldMode: 0644, NewMode: 0644},
+			},
+			summary: diffSummary{Modified: 1, ChunksComparable: true},
+		},
+		{
+			name: "different algorithms",
+			old:  diffTestManifest("blake3", diffTestFile("f", "a", "b")),
+			new:  diffTestManifest("sha256", diffTestFile("f", "a", "b")),
+			changes: []diffFileReport{
+				{Path: "f", Kind: changeModified, OldSize: 300, NewSize: 300, OldMode: 0644, NewMode: 0644},
+			},
+			summary: diffSummary{Modified: 1, NewUniqueChunks: 2, NewUniqueBytes: 300, NewTotalBytes: 300, ChangedPct: 100},
+		},
+	}
+	for _, tt := range tests {
+		report := buildDiffReport(tt.old, tt.new)
+		if !reflect.DeepEqual(report.Changes, tt.changes) {
+			t.Errorf("%s: changes = %+v, want %+v", tt.name, report.Changes, tt.changes)
+		}
+		if report.Summary != tt.summary {
+			t.Errorf("%s: summary = %+v, want %+v", tt.name, report.Summary, tt.summary)
+		}
+	}
+}
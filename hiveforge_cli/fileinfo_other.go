@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileInode is unavailable here; cache entries fall back to path, size and mtime.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
+
+// fileOwner is unavailable here; manifests simply omit uid and gid.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
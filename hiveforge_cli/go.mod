@@ -3,13 +3,17 @@ module github.com/lajosnagyuk/hiveforge
 go 1.22.4
 
 require (
-	github.com/golang-jwt/jwt/v4 v4.5.0 // indirect
+	github.com/golang-jwt/jwt/v4 v4.5.0
+	github.com/klauspost/compress v1.18.0
+	github.com/schollz/progressbar/v3 v3.14.4
+	github.com/zeebo/blake3 v0.2.3
+	golang.org/x/term v0.22.0
+)
+
+require (
 	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	github.com/schollz/progressbar/v3 v3.14.4 // indirect
-	github.com/zeebo/blake3 v0.2.3 // indirect
 	golang.org/x/crypto v0.25.0 // indirect
 	golang.org/x/sys v0.22.0 // indirect
-	golang.org/x/term v0.22.0 // indirect
 )
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const hashCacheFile = "hash_cache.json"
+
+// Files modified this recently are not cached: a write landing in the same
+// mtime tick as our read would otherwise go unnoticed on the next run.
+const hashCacheRacyWindow = 2 * time.Second
+
+type hashCacheEntry struct {
+	Size     int64      `json:"size"`
+	ModTime  int64      `json:"mtime"` // UnixNano
+	Inode    uint64     `json:"inode"`
+	Chunking string     `json:"chunking"`
+	Hashes   FileHashes `json:"hashes"`
+}
+
+// hashCache remembers FileHashes between runs, keyed by absolute path and
+// validated against the file's size, mtime, inode, chunking parameters and
+// hash algorithm. The whole cache, chunk lists included, is loaded into
+// memory and rewritten on save, so its cost grows with the number of files
+// cached; it is not sharded.
+// A nil *hashCache is valid and never hits.
+type hashCache struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string]hashCacheEntry
+	touched map[string]bool // hit or stored in this run
+}
+
+func defaultHashCachePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".hiveforge", hashCacheFile), nil
+}
+
+// loadHashCache reads the cache file. A missing or unreadable cache is not an
+// error; it just starts out empty, with a warning on out.
+func loadHashCache(path string, out io.Writer) *hashCache {
+	cache := newHashCache(path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		fmt.Fprintf(out, "Warning: Ignoring unreadable hash cache %s: %v\n", path, err)
+		cache.entries = make(map[string]hashCacheEntry)
+	}
+	return cache
+}
+
+func chunkingCacheKey(params ChunkingParams, hasher Hasher) string {
+	return fmt.Sprintf("%s/%s/%d/%d/%d", hasher.Name(), params.Scheme, params.MinSize, params.AvgSize, params.MaxSize)
+}
+
+func (c *hashCache) lookup(path string, info os.FileInfo, params ChunkingParams, hasher Hasher) (FileHashes, bool) {
+	if c == nil {
+		return FileHashes{}, false
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return FileHashes{}, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok ||
+		entry.Size != info.Size() ||
+		entry.ModTime != info.ModTime().UnixNano() ||
+		entry.Inode != fileInode(info) ||
+		entry.Chunking != chunkingCacheKey(params, hasher) {
+		return FileHashes{}, false
+	}
+	c.touched[key] = true
+	return entry.Hashes, true
+}
+
+func (c *hashCache) store(path string, info os.FileInfo, params ChunkingParams, hasher Hasher, hashes FileHashes) {
+	if c == nil || time.Since(info.ModTime()) < hashCacheRacyWindow {
+		return
+	}
+	// Only cache complete reads; a size mismatch means the file changed under us
+	if hashes.TotalSize != info.Size() {
+		return
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.touched[key] = true
+	c.entries[key] = hashCacheEntry{
+		Size:     info.Size(),
+		ModTime:  info.ModTime().UnixNano(),
+		Inode:    fileInode(info),
+		Chunking: chunkingCacheKey(params, hasher),
+		Hashes:   hashes,
+	}
+}
+
+// newHashCache returns an empty cache. With an empty path it is kept in
+// memory only, which still lets an interrupted run write a checkpoint.
+func newHashCache(path string) *hashCache {
+	return &hashCache{
+		path:    path,
+		entries: make(map[string]hashCacheEntry),
+		touched: make(map[string]bool),
+	}
+}
+
+// save drops entries under rootPath that were not used in this run (deleted,
+// changed or now ignored files) and atomically rewrites the cache file.
+func (c *hashCache) save(rootPath string) error {
+	if c == nil || c.path == "" {
+		return nil
+	}
+	root, err := filepath.Abs(rootPath)
+	if err != nil {
+		return err
+	}
+	prefix := root + string(filepath.Separator)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) && !c.touched[key] {
+			delete(c.entries, key)
+		}
+	}
+	return writeHashCacheFile(c.path, c.entries)
+}
+
+// saveUnpruned rewrites the cache file without dropping anything, for a walk
+// that did not see the whole tree.
+func (c *hashCache) saveUnpruned() error {
+	if c == nil || c.path == "" {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return writeHashCacheFile(c.path, c.entries)
+}
+
+func writeHashCacheFile(path string, entries map[string]hashCacheEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode hash cache: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeFileInfo overrides the size and mtime of a real file's info.
+type fakeFileInfo struct {
+	os.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (f fakeFileInfo) Size() int64        { return f.size }
+func (f fakeFileInfo) ModTime() time.Time { return f.modTime }
+
+func TestHashCacheLookup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("cached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := testChunkingParams()["fixed"]
+	cache := newHashCache("")
+	cache.store(path, info, params, blake3Hasher{}, FileHashes{Digest: "d", TotalSize: info.Size()})
+	if got, hit := cache.lookup(path, info, params, blake3Hasher{}); !hit || got.Digest != "d" {
+		t.Fatalf("lookup of an unchanged file = %q, %v; want a hit", got.Digest, hit)
+	}
+
+	misses := map[string]func() (os.FileInfo, ChunkingParams, Hasher){
+		"size": func() (os.FileInfo, ChunkingParams, Hasher) {
+			return fakeFileInfo{info, info.Size() + 1, info.ModTime()}, params, blake3Hasher{}
+		},
+		"mtime": func() (os.FileInfo, ChunkingParams, Hasher) {
+			return fakeFileInfo{info, info.Size(), info.ModTime().Add(time.Nanosecond)}, params, blake3Hasher{}
+		},
+		"chunking": func() (os.FileInfo, ChunkingParams, Hasher) {
+			return info, testChunkingParams()["fastcdc"], blake3Hasher{}
+		},
+		"algorithm": func() (os.FileInfo, ChunkingParams, Hasher) {
+			return info, params, sha256Hasher{}
+		},
+	}
+	for name, change := range misses {
+		info, params, hasher := change()
+		if _, hit := cache.lookup(path, info, params, hasher); hit {
+			t.Errorf("lookup after a %s change hit the cache", name)
+		}
+	}
+
+	// Same size and mtime, but a new file in place of the old one
+	replacement := filepath.Join(dir, "b.txt")
+	if err := os.WriteFile(replacement, []byte("CACHED"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(replacement, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInode(replaced) == 0 {
+		t.Skip("no inode numbers on this platform")
+	}
+	if _, hit := cache.lookup(path, replaced, params, blake3Hasher{}); hit {
+		t.Error("lookup after an inode change hit the cache")
+	}
+}
+
+func TestHashCacheAcrossRuns(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	path := filepath.Join(root, "a.txt")
+	if err := os.WriteFile(path, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := HashOptions{
+		Chunking: testChunkingParams()["fixed"],
+		Hasher:   blake3Hasher{},
+		Jobs:     1,
+		Symlinks: symlinksFollow,
+		Progress: progressNone,
+	}
+	hash := func(noCache bool) string {
+		opts.NoCache = noCache
+		result, err := hashDirectory(context.Background(), root, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.RootDigest
+	}
+	cachePath, err := defaultHashCachePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := hash(true)
+	if _, err := os.Stat(cachePath); err == nil {
+		t.Fatal("a run with NoCache wrote the cache file")
+	}
+	if got := hash(false); got != original {
+		t.Fatalf("digest with the cache = %s, want %s", got, original)
+	}
+	if _, err := os.Stat(cachePath); err != nil {
+		t.Fatalf("cache file not written: %v", err)
+	}
+
+	// Rewritten in place with size, mtime and inode kept: only a run that
+	// reads the file again sees the change
+	if err := os.WriteFile(path, []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if got := hash(false); got != original {
+		t.Errorf("digest of an unchanged-looking file = %s, want the cached %s", got, original)
+	}
+	if got := hash(true); got == original {
+		t.Error("a run with NoCache used the cached digest")
+	}
+}
@@ -2,55 +2,69 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
-	"strings"
+	"os/signal"
+	"runtime"
 	"sync"
+	"syscall"
 	"time"
-	"encoding/json"
 
 	"github.com/schollz/progressbar/v3"
-	"github.com/zeebo/blake3"
 )
 
 const (
 	minChunkSize = 64 * 1024   // 64 KB
 	maxChunkSize = 1024 * 1024 // 1 MB
-	maxChunks    = 1024
-	outputLines  = 8
+	targetChunks = 1024 // fixed chunks grow up to maxChunkSize to stay near this count
 )
 
-type IgnoreRules struct {
-	patterns []string
-	source   string // to keep track of where the rule came from
-}
-
-type IgnoredItem struct {
-	Path   string
-	Reason string
-}
-
 type HashingOutput struct {
-    bar            *progressbar.ProgressBar
+    mode           string // a resolved progress mode, never "auto"
+    bar            *progressbar.ProgressBar // bar mode only
+    progressWriter io.Writer
+    out            io.Writer // summary and warnings
+    stopProgress   chan struct{}
+    progressDone   chan struct{}
     mutex          sync.Mutex
-    recentFiles    []string
-    ignoredItems   []IgnoredItem
+    ignored        *ignoredCollector
     totalFiles     int
     processedFiles int
     totalSize      int64
     processedSize  int64
+    walkDone       bool
     startTime      time.Time
     currentFile    string
-    isCompleted    bool
-    lastLines      int
+    recentFiles    []string // bar mode: the current file and those started before it
+    lastLines      int      // bar mode: lines of status to clear before redrawing
+    cacheEnabled   bool
+    cacheHits      int
+    cacheMisses    int
+    specialFiles   int // special files skipped without --skip-special
 }
 
-func newHashingOutput(totalSize int64, totalFiles int) *HashingOutput {
-    return &HashingOutput{
-        bar: progressbar.NewOptions64(
-            totalSize,
+// newHashingOutput starts with empty totals; the directory walk grows them
+// through addPending as it discovers files.
+func newHashingOutput(progress string, ignoredReport io.Writer, out io.Writer) *HashingOutput {
+    ho := &HashingOutput{
+        mode:           resolveProgressMode(progress),
+        progressWriter: os.Stderr,
+        out:            out,
+        ignored:        newIgnoredCollector(ignoredReport),
+        startTime:      time.Now(),
+    }
+    if ho.mode == progressBar {
+        // Drawn by writeBarStatus together with the current and recent files
+        ho.bar = progressbar.NewOptions64(
+            1,
+            progressbar.OptionSetWriter(io.Discard),
             progressbar.OptionSetWidth(50),
             progressbar.OptionSetDescription("Hashing"),
             progressbar.OptionSetRenderBlankState(true),
@@ -58,364 +72,889 @@ func newHashingOutput(totalSize int64, totalFiles int) *HashingOutput {
             progressbar.OptionThrottle(65*time.Millisecond),
             progressbar.OptionShowCount(),
             progressbar.OptionOnCompletion(func() {}), // Empty function to prevent automatic "completed" message
-        ),
-        recentFiles:  make([]string, 0, 5),
-        ignoredItems: make([]IgnoredItem, 0),
-        totalSize:    totalSize,
-        totalFiles:   totalFiles,
-        startTime:    time.Now(),
+        )
     }
+    return ho
 }
 
-func (ho *HashingOutput) updateProgress(size int64) {
+// start begins periodic progress output.
+func (ho *HashingOutput) start() {
+    if ho.mode == progressNone {
+        return
+    }
     ho.mutex.Lock()
-    defer ho.mutex.Unlock()
+    if ho.mode == progressJSON {
+        ho.writeProgress("start")
+    }
+    ho.mutex.Unlock()
 
-    ho.processedSize += size
-    ho.processedFiles++
-    ho.bar.Add64(size)
+    ho.stopProgress = make(chan struct{})
+    ho.progressDone = make(chan struct{})
+    go ho.reportProgress(ho.stopProgress, ho.progressDone)
 }
 
-func (ho *HashingOutput) updateCurrentFile(path string) {
+func (ho *HashingOutput) addPending(size int64) {
     ho.mutex.Lock()
     defer ho.mutex.Unlock()
 
-    ho.currentFile = path
-    ho.recentFiles = append([]string{path}, ho.recentFiles...)
-    if len(ho.recentFiles) > 5 {
-        ho.recentFiles = ho.recentFiles[:5]
+    ho.totalFiles++
+    ho.totalSize += size
+    // The bar stays one byte short of full until the walk is done: once it
+    // reaches its maximum it stops rendering for good, and hashing may catch
+    // up with the walk before every file is discovered.
+    if ho.bar != nil {
+        ho.bar.ChangeMax64(ho.totalSize + 1)
     }
 }
 
-func (ho *HashingOutput) printStatus() {
+func (ho *HashingOutput) walkFinished() {
     ho.mutex.Lock()
     defer ho.mutex.Unlock()
 
-    // Clear previous lines
-    if ho.lastLines > 0 {
-        fmt.Printf("\033[%dA\033[J", ho.lastLines)
+    ho.walkDone = true
+    if ho.bar != nil && ho.totalSize > 0 {
+        ho.bar.ChangeMax64(ho.totalSize)
     }
+}
 
-    // Print new status
-    fmt.Print(ho.bar.String() + "\n")
-    fmt.Printf("Files: %d/%d | Size: %.2f MB / %.2f MB | Time: %s\n",
-        ho.processedFiles, ho.totalFiles,
-        float64(ho.processedSize)/1024/1024,
-        float64(ho.totalSize)/1024/1024,
-        time.Since(ho.startTime).Round(time.Second),
-    )
-    fmt.Printf("Current file: %s\n", ho.currentFile)
-    fmt.Println("Recent files:")
-    
-    recentFilesCount := len(ho.recentFiles)
-    if recentFilesCount > 4 {
-        recentFilesCount = 4
-    }
-    for i := 0; i < recentFilesCount; i++ {
-        fmt.Printf("  %s\n", ho.recentFiles[i])
-    }
+func (ho *HashingOutput) updateProgress(size int64) {
+    ho.mutex.Lock()
+    defer ho.mutex.Unlock()
 
-    // Update lastLines
-    ho.lastLines = 4 + recentFilesCount // 3 for progress, current file, and "Recent files:" + number of recent files
+    ho.processedSize += size
+    ho.processedFiles++
+    if ho.bar != nil {
+        ho.bar.Add64(size)
+    }
 }
 
-func (ho *HashingOutput) complete() {
+func (ho *HashingOutput) recordCacheResult(hit bool) {
     ho.mutex.Lock()
     defer ho.mutex.Unlock()
 
-    ho.isCompleted = true
-    ho.bar.Finish()
+    if hit {
+        ho.cacheHits++
+    } else {
+        ho.cacheMisses++
+    }
 }
 
-func (ho *HashingOutput) printFinalSummary() {
+func (ho *HashingOutput) updateCurrentFile(path string) {
     ho.mutex.Lock()
     defer ho.mutex.Unlock()
 
-    // Clear the last update
-    if ho.lastLines > 0 {
-        fmt.Printf("\033[%dA\033[J", ho.lastLines)
+    ho.currentFile = path
+    if ho.mode == progressBar {
+        ho.recentFiles = append([]string{path}, ho.recentFiles...)
+        if len(ho.recentFiles) > barRecentFiles {
+            ho.recentFiles = ho.recentFiles[:barRecentFiles]
+        }
+    }
+}
+
+// complete stops the progress output and writes its final line.
+func (ho *HashingOutput) complete() {
+    if ho.stopProgress != nil {
+        close(ho.stopProgress)
+        <-ho.progressDone
+        ho.stopProgress = nil
     }
 
-    fmt.Print(ho.bar.String() + "\n")
-    fmt.Println("Hashing completed!")
-    fmt.Printf("Total files processed: %d\n", ho.processedFiles)
-    fmt.Printf("Total size: %.2f MB\n", float64(ho.processedSize)/1024/1024)
-    fmt.Printf("Time taken: %s\n", time.Since(ho.startTime).Round(time.Second))
+    ho.mutex.Lock()
+    defer ho.mutex.Unlock()
 
-    if len(ho.ignoredItems) > 0 {
-        fmt.Println("\nIgnored items:")
-        for _, item := range ho.ignoredItems {
-            fmt.Printf("   %s\n      Reason: %s\n", item.Path, item.Reason)
-        }
+    switch ho.mode {
+    case progressBar:
+        ho.bar.Finish()
+        ho.clearBarStatus()
+        fmt.Fprintln(ho.progressWriter, ho.bar.String())
+    case progressPlain:
+        ho.writeProgress("progress")
+    case progressJSON:
+        ho.writeProgress("done")
     }
 }
 
-func (ho *HashingOutput) updateDisplay() {
-    for {
-        time.Sleep(100 * time.Millisecond)
-        ho.mutex.Lock()
-        if ho.isCompleted {
-            ho.mutex.Unlock()
-            return
+// printFinalSummary prints totals and ignored items for people. In JSON mode
+// the done event carries the totals instead, and --quiet prints only warnings.
+func (ho *HashingOutput) printFinalSummary() {
+    ho.mutex.Lock()
+    defer ho.mutex.Unlock()
+
+    if ho.mode != progressJSON && ho.mode != progressNone {
+        fmt.Fprintln(ho.out, "Hashing completed!")
+        fmt.Fprintf(ho.out, "Total files processed: %d\n", ho.processedFiles)
+        fmt.Fprintf(ho.out, "Total size: %.2f MB\n", float64(ho.processedSize)/1024/1024)
+        fmt.Fprintf(ho.out, "Time taken: %s\n", time.Since(ho.startTime).Round(time.Second))
+        if ho.cacheEnabled {
+            lookups := ho.cacheHits + ho.cacheMisses
+            hitRate := 0.0
+            if lookups > 0 {
+                hitRate = float64(ho.cacheHits) / float64(lookups) * 100
+            }
+            fmt.Fprintf(ho.out, "Hash cache: %d hits, %d misses (%.1f%% hit rate)\n", ho.cacheHits, ho.cacheMisses, hitRate)
         }
-        ho.printStatus()
-        ho.mutex.Unlock()
+
+        printIgnoredSummary(ho.out, ho.ignored.summary(terminalIgnoredGroups))
+    }
+    if ho.specialFiles > 0 {
+        fmt.Fprintf(ho.out, "Warning: Skipped %d special files (devices, sockets or pipes); pass --skip-special to exclude them explicitly\n", ho.specialFiles)
     }
 }
 
-// ====
+func (ho *HashingOutput) addIgnoredItem(item IgnoredItem) {
+	ho.mutex.Lock()
+	defer ho.mutex.Unlock()
+	ho.ignored.add(item)
+}
 
+// addSpecialFile records a skipped special file. Unless they were excluded
+// explicitly with --skip-special, the summary warns about them.
+func (ho *HashingOutput) addSpecialFile(item IgnoredItem, explicit bool) {
+	ho.mutex.Lock()
+	defer ho.mutex.Unlock()
+	ho.ignored.add(item)
+	if !explicit {
+		ho.specialFiles++
+	}
+}
 
 
+// HashOptions controls how a directory is hashed.
+type HashOptions struct {
+	Chunking ChunkingParams
+	Hasher   Hasher
+	Jobs     int  // number of files hashed concurrently
+	NoCache  bool // re-hash every file instead of reusing ~/.hiveforge/hash_cache.json
 
+	Symlinks       string // skip, record or follow
+	SymlinksEscape bool   // let followed links leave the root
 
-func (ho *HashingOutput) addIgnoredItem(path, reason string) {
-	ho.mutex.Lock()
-	defer ho.mutex.Unlock()
-	ho.ignoredItems = append(ho.ignoredItems, IgnoredItem{Path: path, Reason: reason})
+	Ignore  IgnoreOptions // ignore files read besides .hiveignore
+	Filters HashFilters   // size, include and special file filters
+
+	RecordMtime bool // store modification times in the manifest
+	RecordOwner bool // store uid and gid in the manifest
+
+	SkipFiles     []os.FileInfo // never hashed, e.g. the manifest being written
+	IgnoredReport io.Writer     // receives every ignored item as NDJSON, if set
+	Resume        bool          // reuse the files finished by an interrupted run
+	Progress      string        // progress mode, see progress.go; "" is auto
+	Store         *chunkStore   // keeps the bytes of every chunk hashed, if set
+	Output        io.Writer     // summary and warnings; os.Stdout if nil
 }
 
+// output returns where messages for people go.
+func (o HashOptions) output() io.Writer {
+	if o.Output == nil {
+		return os.Stdout
+	}
+	return o.Output
+}
+
+// parseHashFlags registers the hashing flags on fs, parses args and returns
+// the options and the remaining arguments.
+func parseHashFlags(fs *flag.FlagSet, args []string, config Config) (HashOptions, []string, error) {
+	defaultAlgorithm := config.HashAlgorithm
+	if defaultAlgorithm == "" {
+		defaultAlgorithm = algorithmBLAKE3
+	}
+
+	algorithm := fs.String("algorithm", defaultAlgorithm, "Digest algorithm: blake3 or sha256")
+	scheme := fs.String("chunking", chunkingFixed, "Chunking scheme: fixed or fastcdc")
+	cdcMin := fs.Int("cdc-min", defaultCDCMinSize, "Minimum chunk size in bytes for fastcdc")
+	cdcAvg := fs.Int("cdc-avg", defaultCDCAvgSize, "Average chunk size in bytes for fastcdc")
+	cdcMax := fs.Int("cdc-max", defaultCDCMaxSize, "Maximum chunk size in bytes for fastcdc")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "Number of files to hash in parallel")
+	noCache := fs.Bool("no-cache", false, "Ignore and do not update the local hash cache")
+	symlinks := fs.String("symlinks", symlinksFollow, "Symlink policy: skip, record or follow")
+	symlinksEscape := fs.Bool("symlinks-escape", false, "Allow followed symlinks to point outside the root")
+	recordMtime := fs.Bool("mtime", false, "Record modification times in the manifest")
+	recordOwner := fs.Bool("owner", false, "Record file owner uid/gid in the manifest")
+	ignore := addIgnoreFlags(fs, config)
+	maxSize := fs.String("max-size", "", "Skip files larger than this, e.g. 100M or 2G")
+	var include stringList
+	fs.Var(&include, "include", "Only hash paths matching this root-relative glob, e.g. 'src/**' (repeatable)")
+	skipSpecial := fs.Bool("skip-special", false, "Exclude devices, sockets and pipes without a warning")
+	storeChunks := fs.Bool("store-chunks", config.StoreChunks, "Keep the bytes of every chunk in the local chunk store")
+	progress := addProgressFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return HashOptions{}, nil, err
+	}
+
+	chunking, err := defaultChunkingParams(*scheme)
+	if err != nil {
+		return HashOptions{}, nil, err
+	}
+	if chunking.Scheme == chunkingFastCDC {
+		chunking.MinSize, chunking.AvgSize, chunking.MaxSize = *cdcMin, *cdcAvg, *cdcMax
+	}
+	if err := chunking.validate(); err != nil {
+		return HashOptions{}, nil, err
+	}
+
+	if *jobs < 1 {
+		return HashOptions{}, nil, fmt.Errorf("--jobs must be at least 1, got %d", *jobs)
+	}
+
+	if err := validateSymlinkPolicy(*symlinks); err != nil {
+		return HashOptions{}, nil, err
+	}
+	hasher, err := newHasher(*algorithm)
+	if err != nil {
+		return HashOptions{}, nil, err
+	}
+
+	progressMode, err := progress()
+	if err != nil {
+		return HashOptions{}, nil, err
+	}
+
+	filters := HashFilters{Include: include, SkipSpecial: *skipSpecial}
+	if *maxSize != "" {
+		if filters.MaxSize, err = parseByteSize(*maxSize); err != nil {
+			return HashOptions{}, nil, fmt.Errorf("--max-size: %w", err)
+		}
+	}
+	if _, err := compileIncludes(filters.Include); err != nil {
+		return HashOptions{}, nil, err
+	}
+
+	var store *chunkStore
+	if *storeChunks {
+		if store, err = openChunkStore(config); err != nil {
+			return HashOptions{}, nil, err
+		}
+	}
+
+	return HashOptions{
+		Chunking:       chunking,
+		Hasher:         hasher,
+		Jobs:           *jobs,
+		NoCache:        *noCache,
+		Symlinks:       *symlinks,
+		SymlinksEscape: *symlinksEscape,
+		RecordMtime:    *recordMtime,
+		RecordOwner:    *recordOwner,
+		Ignore:         *ignore,
+		Filters:        filters,
+		Progress:       progressMode,
+		Store:          store,
+	}, fs.Args(), nil
+}
 
 func handleHash(args []string, config Config, jwt *JWT) error {
+    fs := flag.NewFlagSet("hash", flag.ContinueOnError)
+    outputPath := fs.String("output", "", "Write the manifest to this file, or - for stdout")
+    noUpload := fs.Bool("no-upload", false, "Do not send the manifest to the controller")
+    dryRun := fs.Bool("dry-run", false, "Hash and report what would be uploaded without sending it")
+    ignoredReport := fs.String("ignored-report", "", "Write every ignored path with its reason to this file as NDJSON")
+    resume := fs.Bool("resume", false, "Continue an interrupted run, reusing the files it finished")
+    push := fs.Bool("push", false, "After uploading the manifest, upload the chunks the controller is missing")
+    uploadJobs := fs.Int("upload-jobs", defaultUploadJobs, "Number of chunks to upload in parallel with --push")
+    opts, args, err := parseHashFlags(fs, args, config)
+    if err != nil {
+        return err
+    }
     if len(args) < 1 {
-        return fmt.Errorf("usage: hiveforgectl hash <directory>")
+        return fmt.Errorf("usage: hiveforgectl hash [--algorithm blake3|sha256] [--chunking fixed|fastcdc] [--jobs N] [--no-cache] [--symlinks skip|record|follow] [--gitignore] [--dockerignore] [--max-size SIZE] [--include GLOB]... [--skip-special] [--ignored-report <path>] [--progress auto|bar|plain|json] [--quiet] [--resume] [--output <path|->] [--no-upload] [--dry-run] [--push [--upload-jobs N]] <directory>")
     }
 
     directory := args[0]
+    opts.Resume = *resume
+    upload := !*noUpload && !*dryRun
+    if *push && !upload {
+        return fmt.Errorf("--push needs the manifest to be uploaded; it cannot be combined with --no-upload or --dry-run")
+    }
+    if upload {
+        // Fail before hashing rather than after
+        if err := checkCredentials(config); err != nil {
+            return err
+        }
+    }
+
+    var writers []io.Writer
+    out := io.Writer(os.Stdout)
+    switch *outputPath {
+    case "":
+    case "-":
+        // stdout carries only the manifest; all other output goes to stderr
+        writers = append(writers, os.Stdout)
+        out = os.Stderr
+    default:
+        file, err := os.Create(*outputPath)
+        if err != nil {
+            return fmt.Errorf("error creating manifest file: %w", err)
+        }
+        defer file.Close()
+        writers = append(writers, file)
+
+        // The manifest may be written inside the tree being hashed
+        if info, err := file.Stat(); err == nil {
+            opts.SkipFiles = append(opts.SkipFiles, info)
+        }
+    }
+
+    // The manifest only summarizes ignored items; the report lists them all
+    var report *bufio.Writer
+    if *ignoredReport != "" {
+        file, err := os.Create(*ignoredReport)
+        if err != nil {
+            return fmt.Errorf("error creating ignored items report: %w", err)
+        }
+        defer file.Close()
+        if info, err := file.Stat(); err == nil {
+            opts.SkipFiles = append(opts.SkipFiles, info)
+        }
+        report = bufio.NewWriter(file)
+        opts.IgnoredReport = report
+    }
+    opts.Output = out
+
+    // For an upload the manifest is spooled to a compressed temporary file
+    // while hashing, so it never has to fit in memory
+    var spool *os.File
+    var gzWriter *gzip.Writer
+    if upload || *dryRun {
+        spool, err = os.CreateTemp("", "hiveforge-manifest-*.ndjson.gz")
+        if err != nil {
+            return fmt.Errorf("error creating manifest spool file: %w", err)
+        }
+        defer os.Remove(spool.Name())
+        defer spool.Close()
+
+        gzWriter = gzip.NewWriter(spool)
+        writers = append(writers, gzWriter)
+    }
+
+    // The first Ctrl-C stops hashing and saves a checkpoint; once it has been
+    // received, the default handling is restored so a second one kills
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    go func() {
+        <-ctx.Done()
+        stop()
+    }()
 
-    result, err := hashDirectory(directory)
+    trailer, err := hashDirectoryTo(ctx, directory, opts, newNDJSONSink(io.MultiWriter(writers...)))
     if err != nil {
-        return fmt.Errorf("error hashing directory: %w", err)
+        if *outputPath != "" && *outputPath != "-" {
+            // An incomplete manifest must not be mistaken for a finished one
+            os.Remove(*outputPath)
+        }
+        return err
+    }
+    if gzWriter != nil {
+        if err := gzWriter.Close(); err != nil {
+            return fmt.Errorf("error compressing manifest: %w", err)
+        }
+    }
+    if *outputPath != "" && *outputPath != "-" {
+        fmt.Fprintf(out, "Manifest written to %s\n", *outputPath)
+    }
+    if report != nil {
+        if err := report.Flush(); err != nil {
+            return fmt.Errorf("error writing ignored items report: %w", err)
+        }
+        fmt.Fprintf(out, "Ignored items report written to %s\n", *ignoredReport)
+    }
+    if opts.Store != nil {
+        if err := opts.Store.enforceLimit(out); err != nil {
+            fmt.Fprintf(out, "Warning: %v\n", err)
+        }
     }
 
-    if err := sendHashResultToAPI(config, jwt, result); err != nil {
+    if *dryRun {
+        info, err := spool.Stat()
+        if err != nil {
+            return fmt.Errorf("error reading manifest spool file: %w", err)
+        }
+        fmt.Fprintf(out, "Dry run: would upload a manifest of %d files (%.2f MB) to http://%s:%d/api/v1/hash-results, %d bytes compressed\n",
+            trailer.TotalFiles, float64(trailer.TotalSize)/1024/1024, config.ApiEndpoint, config.Port, info.Size())
+        return nil
+    }
+    if !upload {
+        return nil
+    }
+    if jwt == nil {
+        jwt = &JWT{}
+    }
+
+    id, err := sendManifestToAPI(out, config, jwt, directory, trailer, spool)
+    if err != nil {
         return fmt.Errorf("error sending hash result to API: %w", err)
     }
 
-    fmt.Println("Hash result successfully sent, handleHash complete.")
-    return nil
+    fmt.Fprintln(out, "Hash result successfully sent, handleHash complete.")
+    if !*push {
+        return nil
+    }
+
+    // The chunks to upload are located in the spooled manifest
+    readManifest := func(sink manifestSink) error {
+        if _, err := spool.Seek(0, io.SeekStart); err != nil {
+            return err
+        }
+        gzReader, err := gzip.NewReader(spool)
+        if err != nil {
+            return err
+        }
+        defer gzReader.Close()
+        return readManifestStream(gzReader, sink)
+    }
+    pushOpts := PushOptions{Jobs: *uploadJobs, Progress: opts.Progress, Store: opts.Store, Output: out}
+    if pushOpts.Store == nil {
+        // Chunks kept by earlier runs still save reading the files
+        if pushOpts.Store, err = openChunkStore(config); err != nil {
+            return err
+        }
+    }
+    return pushChunks(ctx, config, jwt, id, directory, readManifest, pushOpts)
+}
+
+// hashDirectory hashes rootPath into an in-memory tree.
+func hashDirectory(ctx context.Context, rootPath string, opts HashOptions) (*DirectoryHashResult, error) {
+	sink := newTreeSink()
+	if _, err := hashDirectoryTo(ctx, rootPath, opts, sink); err != nil {
+		return nil, err
+	}
+	return &sink.result, nil
 }
 
-func hashDirectory(rootPath string) (*DirectoryHashResult, error) {
-	var totalSize int64
-	var totalFiles int
+// hashDirectoryTo hashes rootPath and writes the manifest to sink while the
+// walk is still running, so the manifest itself is never held in memory. The
+// hash cache is: it keeps an entry with the chunk list of every file hashed,
+// also with NoCache (in memory only, for a checkpoint), so memory use still
+// grows with the number of files.
+//
+// If ctx is cancelled, the walk stops, files being hashed are abandoned, and
+// the files finished so far are saved to a checkpoint that a run with
+// opts.Resume picks up again.
+func hashDirectoryTo(ctx context.Context, rootPath string, opts HashOptions, sink manifestSink) (manifestTrailer, error) {
+	entries, err := os.ReadDir(rootPath)
+	if err != nil {
+		return manifestTrailer{}, err
+	}
+	rootInfo, err := os.Stat(rootPath)
+	if err != nil {
+		return manifestTrailer{}, err
+	}
 
-	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+	out := opts.output()
+	output := newHashingOutput(opts.Progress, opts.IgnoredReport, out)
+
+	var cache *hashCache
+	if !opts.NoCache {
+		cachePath, err := defaultHashCachePath()
 		if err != nil {
-			return err
+			fmt.Fprintf(out, "Warning: Hash cache disabled: %v\n", err)
+		} else {
+			cache = loadHashCache(cachePath, out)
+			output.cacheEnabled = true
 		}
-		if !info.IsDir() {
-			totalSize += info.Size()
-			totalFiles++
+	}
+	if cache == nil {
+		// Finished files are still remembered in memory, for a checkpoint
+		cache = newHashCache("")
+	}
+
+	// Other runs on the same root, such as verify or a hash with different
+	// options, leave the checkpoint for the --resume it was written for
+	resumed := false
+	checkpoint, err := checkpointPath(rootPath)
+	if err != nil {
+		fmt.Fprintf(out, "Warning: Checkpoints disabled: %v\n", err)
+	} else if opts.Resume {
+		count, err := cache.loadCheckpoint(checkpoint)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			fmt.Fprintf(out, "Warning: No checkpoint for %s, hashing from the start\n", rootPath)
+		case err != nil:
+			fmt.Fprintf(out, "Warning: %v, hashing from the start\n", err)
+		default:
+			fmt.Fprintf(out, "Resuming from checkpoint: %d files already hashed\n", count)
+			resumed = true
 		}
-		return nil
-	})
+	}
+
+	guard, err := newSymlinkGuard(rootPath, opts)
 	if err != nil {
-		return nil, err
+		return manifestTrailer{}, err
 	}
 
-	output := newHashingOutput(totalSize, totalFiles)
+	err = sink.writeHeader(manifestHeader{
+		RootPath:       rootPath,
+		Algorithm:      opts.Hasher.Name(),
+		Chunking:       opts.Chunking,
+		Symlinks:       opts.Symlinks,
+		SymlinksEscape: opts.SymlinksEscape,
+		IgnoreSources:  opts.Ignore.sources(),
+		Filters:        opts.Filters.manifestFilters(),
+	})
+	if err != nil {
+		return manifestTrailer{}, fmt.Errorf("error writing manifest: %w", err)
+	}
 
-	ignoreRules := loadIgnoreRules(rootPath, &IgnoreRules{})
-	rootEntry, err := processDirectory(rootPath, rootPath, ignoreRules, output)
+	includes, err := compileIncludes(opts.Filters.Include)
 	if err != nil {
-		return nil, err
+		return manifestTrailer{}, err
 	}
 
+	walk := &treeWalk{
+		ctx:      ctx,
+		rootPath: rootPath,
+		guard:    guard,
+		includes: includes,
+		pool:     newHashPool(ctx, opts.Jobs, opts, cache, output),
+		output:   output,
+		events:   make(chan walkEvent, opts.Jobs*64),
+	}
+	output.start()
+	go func() {
+		ignoreRules := newIgnoreRules(rootPath, opts.Ignore)
+		rootEntry := &DirectoryEntry{Name: filepath.Base(rootPath), Type: "directory"}
+		setEntryMetadata(rootEntry, rootInfo, opts)
+		walk.events <- walkEvent{kind: walkEnterDir}
+		processDirectory(walk, rootPath, ".", guard.realRoot, entries, ignoreRules, len(walk.includes) == 0)
+		output.walkFinished()
+		walk.events <- walkEvent{kind: walkLeaveDir, relPath: ".", entry: rootEntry}
+		walk.pool.wait()
+		close(walk.events)
+	}()
+
+	rootEntry, err := writeManifestEntries(walk.events, sink, opts.Hasher, output)
 	output.complete()
-	output.printFinalSummary()
+	if ctx.Err() != nil {
+		return manifestTrailer{}, interruptHashing(ctx, out, rootPath, cache, checkpoint)
+	}
+	if err != nil {
+		return manifestTrailer{}, fmt.Errorf("error writing manifest: %w", err)
+	}
 
-    result := &DirectoryHashResult{
-        RootPath:           rootPath,
-        DirectoryStructure: rootEntry,
-        TotalSize:          rootEntry.Size,
-        TotalFiles:         output.processedFiles,
-        HashingTime:        time.Since(output.startTime).Seconds(),
-        IgnoredItems:       output.ignoredItems,
-    }
+	if err := cache.save(rootPath); err != nil {
+		fmt.Fprintf(out, "Warning: Failed to save hash cache: %v\n", err)
+	}
+	if resumed {
+		// Done; the checkpoint this run resumed from is of no further use
+		if err := os.Remove(checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(out, "Warning: Failed to remove checkpoint: %v\n", err)
+		}
+	}
 
-    // Write the result to a JSON file for debugging
-    if err := writeResultToJSONFile(result, "hash_result_debug.json"); err != nil {
-        fmt.Printf("Warning: Failed to write debug JSON file: %v\n", err)
-    } else {
-        fmt.Println("Debug: JSON result written to hash_result_debug.json")
-    }
+	output.printFinalSummary()
 
-    return result, nil
+	trailer := manifestTrailer{
+		RootDigest:   rootEntry.Digest,
+		TotalSize:    rootEntry.Size,
+		TotalFiles:   output.processedFiles,
+		HashingTime:  time.Since(output.startTime).Seconds(),
+		Ignored:      output.ignored.summary(manifestIgnoredGroups),
+	}
+	if err := sink.writeTrailer(trailer); err != nil {
+		return manifestTrailer{}, fmt.Errorf("error writing manifest: %w", err)
+	}
+	return trailer, nil
 }
 
-func writeResultToJSONFile(result *DirectoryHashResult, filename string) error {
-    // Create a pretty-printed JSON
-    jsonData, err := json.MarshalIndent(result, "", "  ")
-    if err != nil {
-        return fmt.Errorf("failed to marshal result to JSON: %w", err)
-    }
+// interruptHashing saves what an interrupted run finished, both to the hash
+// cache and to the checkpoint for --resume.
+func interruptHashing(ctx context.Context, out io.Writer, rootPath string, cache *hashCache, checkpoint string) error {
+	// The walk did not see the whole tree, so nothing is pruned
+	if err := cache.saveUnpruned(); err != nil {
+		fmt.Fprintf(out, "Warning: Failed to save hash cache: %v\n", err)
+	}
+	if checkpoint == "" {
+		return fmt.Errorf("hashing interrupted: %w", ctx.Err())
+	}
+	saved, err := cache.saveCheckpoint(checkpoint, rootPath)
+	if err != nil {
+		return fmt.Errorf("hashing interrupted, and the checkpoint could not be saved: %v: %w", err, ctx.Err())
+	}
+	fmt.Fprintf(out, "Interrupted: saved a checkpoint of %d hashed files. Run the same command with --resume to continue.\n", saved)
+	return fmt.Errorf("hashing interrupted: %w", ctx.Err())
+}
 
-    // Write to file
-    err = os.WriteFile(filename, jsonData, 0644)
-    if err != nil {
-        return fmt.Errorf("failed to write JSON to file: %w", err)
-    }
+const (
+	walkEnterDir = iota
+	walkLeaveDir
+	walkFile
+	walkSymlink
+)
 
-    return nil
+// walkEvent is one step of the directory walk, sent in walk order.
+type walkEvent struct {
+	kind    int
+	relPath string          // relative to the root with forward slashes, "." for the root
+	entry   *DirectoryEntry // walkSymlink: the link; walkLeaveDir: the directory's own metadata
+	job     *fileJob        // walkFile
 }
 
-func processDirectory(rootPath string, dirPath string, rules *IgnoreRules, output *HashingOutput) (*DirectoryEntry, error) {
-    entries, err := os.ReadDir(dirPath)
-    if err != nil {
-        return nil, err
-    }
+// treeWalk is the state shared by one directory walk.
+type treeWalk struct {
+	ctx      context.Context
+	rootPath string
+	guard    *symlinkGuard
+	includes []ignorePattern // compiled --include globs
+	pool     *hashPool
+	output   *HashingOutput
+	events   chan walkEvent
+}
 
-    dirEntry := &DirectoryEntry{
-        Name: filepath.Base(dirPath),
-        Type: "directory",
-    }
+// processDirectory walks dirPath, whose symlink-free location is realDir, and
+// emits its contents. Files go to the pool and, in the same order, to the
+// event stream.
+func processDirectory(walk *treeWalk, dirPath string, relDir string, realDir string, entries []os.DirEntry, rules *IgnoreRules, included bool) {
+    guard, output := walk.guard, walk.output
+
+    guard.enter(realDir)
+    defer guard.leave(realDir)
 
     for _, entry := range entries {
+        if walk.ctx.Err() != nil {
+            return
+        }
         childPath := filepath.Join(dirPath, entry.Name())
-        
-        // Get file info, following symlinks
-        info, err := os.Stat(childPath)
+        realChild := filepath.Join(realDir, entry.Name())
+        relChild := path.Join(relDir, entry.Name())
+
+        info, err := os.Lstat(childPath)
         if err != nil {
-            output.addIgnoredItem(childPath, fmt.Sprintf("Error getting file info: %v", err))
+            output.addIgnoredItem(IgnoredItem{Path: childPath, Kind: ignoreKindError, Reason: fmt.Sprintf("Error getting file info: %v", err)})
             continue
         }
 
-        ignored, reason := shouldIgnore(childPath, info.IsDir(), rootPath, rules)
-        if ignored {
-            output.addIgnoredItem(childPath, reason)
+        isLink := info.Mode()&os.ModeSymlink != 0
+        if isLink && guard.policy == symlinksFollow {
+            realChild, info, err = guard.resolve(childPath)
+            if err != nil {
+                output.addIgnoredItem(IgnoredItem{Path: childPath, Kind: ignoreKindSymlink, Reason: fmt.Sprintf("Skipped symlink: %v", err)})
+                continue
+            }
+            isLink = false
+        }
+
+        if isSkippedFile(info, walk.pool.opts.SkipFiles) {
+            output.addIgnoredItem(IgnoredItem{Path: childPath, Kind: ignoreKindOutput, Reason: "Skipped manifest output file"})
+            continue
+        }
+
+        if item, ignored := shouldIgnore(childPath, info.IsDir(), walk.rootPath, rules); ignored {
+            output.addIgnoredItem(item)
             continue
         }
 
-        if info.IsDir() {
-            childRules := loadIgnoreRules(childPath, rules)
-            childEntry, err := processDirectory(rootPath, childPath, childRules, output)
+        // Below a directory matched by --include everything is included;
+        // other directories are only entered if a pattern could match inside
+        childIncluded := included
+        if !included {
+            if matchInclude(walk.includes, relChild) != nil {
+                childIncluded = true
+            } else if !info.IsDir() || !mayIncludeBelow(walk.includes, relChild) {
+                output.addIgnoredItem(IgnoredItem{Path: childPath, Kind: ignoreKindNotIncluded, Reason: "Not matched by any --include pattern"})
+                continue
+            }
+        }
+
+        if isLink {
+            if guard.policy == symlinksSkip {
+                output.addIgnoredItem(IgnoredItem{Path: childPath, Kind: ignoreKindSymlink, Reason: "Skipped symlink"})
+                continue
+            }
+            target, err := os.Readlink(childPath)
             if err != nil {
-                output.addIgnoredItem(childPath, fmt.Sprintf("Error processing directory: %v", err))
+                output.addIgnoredItem(IgnoredItem{Path: childPath, Kind: ignoreKindError, Reason: fmt.Sprintf("Error reading symlink: %v", err)})
                 continue
             }
-            dirEntry.Children = append(dirEntry.Children, childEntry)
-            dirEntry.Size += childEntry.Size
-        } else if info.Mode().IsRegular() {
-            childEntry, err := processFile(childPath, info, output)
+            linkEntry := &DirectoryEntry{
+                Name:   entry.Name(),
+                Type:   "symlink",
+                Target: filepath.ToSlash(target),
+            }
+            setEntryMetadata(linkEntry, info, walk.pool.opts)
+            walk.events <- walkEvent{kind: walkSymlink, relPath: relChild, entry: linkEntry}
+        } else if info.IsDir() {
+            childEntries, err := os.ReadDir(childPath)
             if err != nil {
-                output.addIgnoredItem(childPath, fmt.Sprintf("Error processing file: %v", err))
+                output.addIgnoredItem(IgnoredItem{Path: childPath, Kind: ignoreKindError, Reason: fmt.Sprintf("Error processing directory: %v", err)})
+                continue
+            }
+            childRules := loadIgnoreRules(walk.rootPath, childPath, rules)
+            dirEntry := &DirectoryEntry{Name: entry.Name(), Type: "directory"}
+            setEntryMetadata(dirEntry, info, walk.pool.opts)
+
+            walk.events <- walkEvent{kind: walkEnterDir}
+            processDirectory(walk, childPath, relChild, realChild, childEntries, childRules, childIncluded)
+            walk.events <- walkEvent{kind: walkLeaveDir, relPath: relChild, entry: dirEntry}
+        } else if info.Mode().IsRegular() {
+            if maxSize := walk.pool.opts.Filters.MaxSize; maxSize > 0 && info.Size() > maxSize {
+                output.addIgnoredItem(IgnoredItem{
+                    Path:   childPath,
+                    Kind:   ignoreKindMaxSize,
+                    Reason: fmt.Sprintf("Larger than --max-size of %d bytes", maxSize),
+                    Size:   info.Size(),
+                })
                 continue
             }
-            dirEntry.Children = append(dirEntry.Children, childEntry)
-            dirEntry.Size += childEntry.Size
+            job := newFileJob(childPath, info)
+            output.addPending(info.Size())
+            walk.pool.submit(job)
+            walk.events <- walkEvent{kind: walkFile, relPath: relChild, job: job}
         } else {
-            // Handle special files (e.g., symlinks, devices)
-            output.addIgnoredItem(childPath, "Skipped special file")
+            // Special files (devices, sockets, pipes) have no content to hash
+            output.addSpecialFile(IgnoredItem{Path: childPath, Kind: ignoreKindSpecial, Reason: "Skipped " + specialFileType(info.Mode())},
+                walk.pool.opts.Filters.SkipSpecial)
         }
-
-        output.updateProgress(info.Size())
     }
-
-    return dirEntry, nil
 }
-func processFile(path string, info os.FileInfo, output *HashingOutput) (*DirectoryEntry, error) {
-	output.updateCurrentFile(path)
 
-	hashes, err := hashFile(path)
-	if err != nil {
-		return nil, err
+func isSkippedFile(info os.FileInfo, skip []os.FileInfo) bool {
+	for _, skipped := range skip {
+		if os.SameFile(info, skipped) {
+			return true
+		}
 	}
-
-	return &DirectoryEntry{
-		Name:   info.Name(),
-		Type:   "file",
-		Size:   info.Size(),
-		Hashes: &hashes,
-	}, nil
+	return false
 }
 
-func loadIgnoreRules(dirPath string, parentRules *IgnoreRules) *IgnoreRules {
-	ignoreFilePath := filepath.Join(dirPath, ".hiveignore")
-	file, err := os.Open(ignoreFilePath)
-	if err != nil {
-		// If .hiveignore doesn't exist, return parent rules
-		return parentRules
-	}
-	defer file.Close()
+// dirFrame collects what a directory's size and Merkle digest need from its
+// children: their names, types, modes and digests, but no chunk lists.
+type dirFrame struct {
+	children []*DirectoryEntry
+	size     int64
+}
 
-	newRules := &IgnoreRules{
-		patterns: make([]string, len(parentRules.patterns)),
-		source:   ignoreFilePath,
+// writeManifestEntries turns walk events into post-order manifest entries,
+// filling in directory sizes and digests as each directory is left. It
+// returns the root entry. After a sink error it keeps draining events so the
+// walk can finish.
+func writeManifestEntries(events <-chan walkEvent, sink manifestSink, hasher Hasher, output *HashingOutput) (*DirectoryEntry, error) {
+	var stack []*dirFrame
+	var root *DirectoryEntry
+	var sinkErr error
+
+	emit := func(relPath string, entry *DirectoryEntry) {
+		if sinkErr == nil {
+			sinkErr = sink.writeEntry(relPath, entry)
+		}
+		if len(stack) == 0 {
+			root = entry
+			return
+		}
+		parent := stack[len(stack)-1]
+		parent.children = append(parent.children, &DirectoryEntry{
+			Name:   entry.Name,
+			Type:   entry.Type,
+			Mode:   entry.Mode,
+			Target: entry.Target,
+			Digest: entryDigest(entry, hasher),
+		})
+		parent.size += entry.Size
 	}
-	copy(newRules.patterns, parentRules.patterns)
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		pattern := strings.TrimSpace(scanner.Text())
-		if pattern != "" && !strings.HasPrefix(pattern, "#") {
-			newRules.patterns = append(newRules.patterns, pattern)
+	for event := range events {
+		switch event.kind {
+		case walkEnterDir:
+			stack = append(stack, &dirFrame{})
+		case walkLeaveDir:
+			frame := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			event.entry.Size = frame.size
+			event.entry.Digest = directoryDigest(frame.children, hasher)
+			emit(event.relPath, event.entry)
+		case walkSymlink:
+			emit(event.relPath, event.entry)
+		case walkFile:
+			<-event.job.done
+			if errors.Is(event.job.err, context.Canceled) {
+				continue // interrupted, nothing to report
+			}
+			if event.job.err != nil {
+				output.addIgnoredItem(IgnoredItem{Path: event.job.path, Kind: ignoreKindError, Reason: fmt.Sprintf("Error processing file: %v", event.job.err)})
+				continue
+			}
+			emit(event.relPath, event.job.entry)
 		}
 	}
-
-	return newRules
+	return root, sinkErr
 }
 
-func shouldIgnore(path string, isDir bool, rootPath string, rules *IgnoreRules) (bool, string) {
-	relPath, err := filepath.Rel(rootPath, path)
-	if err != nil {
-		return false, ""
-	}
-
-	// Always use forward slashes for consistency
-	relPath = filepath.ToSlash(relPath)
+func processFile(ctx context.Context, path string, info os.FileInfo, opts HashOptions, cache *hashCache, output *HashingOutput) (*DirectoryEntry, error) {
+	output.updateCurrentFile(path)
 
-	for _, pattern := range rules.patterns {
-		matched, err := matchIgnorePattern(relPath, pattern, isDir)
+	hashes, hit := cache.lookup(path, info, opts.Chunking, opts.Hasher)
+	if hit && opts.Store != nil && !opts.Store.hasAll(opts.Hasher.Name(), hashes.Hashes) {
+		// Hashed before, but its chunks are not in the store (any more)
+		hit = false
+	}
+	if !hit {
+		var err error
+		hashes, err = hashFile(ctx, path, opts.Chunking, opts.Hasher, opts.Store)
 		if err != nil {
-			continue
-		}
-		if matched {
-			return true, fmt.Sprintf("Matched pattern '%s' from %s", pattern, rules.source)
+			return nil, err
 		}
+		cache.store(path, info, opts.Chunking, opts.Hasher, hashes)
 	}
-	return false, ""
+	output.recordCacheResult(hit)
+
+	fileEntry := &DirectoryEntry{
+		// A followed link keeps its own name; info describes the target
+		Name:   filepath.Base(path),
+		Type:   "file",
+		Size:   info.Size(),
+		Hashes: &hashes,
+	}
+	setEntryMetadata(fileEntry, info, opts)
+	return fileEntry, nil
 }
 
-func matchIgnorePattern(path string, pattern string, isDir bool) (bool, error) {
-	// Handle directory-only patterns (ending with '/')
-	if strings.HasSuffix(pattern, "/") {
-		if !isDir {
-			return false, nil
+// setEntryMetadata copies the permission bits, and optionally mtime and
+// ownership, from info. Symlink permissions are meaningless and left at zero.
+func setEntryMetadata(entry *DirectoryEntry, info os.FileInfo, opts HashOptions) {
+	if info.Mode()&os.ModeSymlink == 0 {
+		entry.Mode = posixMode(info.Mode())
+	}
+	if opts.RecordMtime {
+		entry.ModTime = info.ModTime().UTC().Format(time.RFC3339Nano)
+	}
+	if opts.RecordOwner {
+		if uid, gid, ok := fileOwner(info); ok {
+			entry.UID, entry.GID = &uid, &gid
 		}
-		pattern = strings.TrimSuffix(pattern, "/")
 	}
+}
 
-	// If the pattern doesn't contain a slash, it matches in any directory
-	if !strings.Contains(pattern, "/") {
-		return filepath.Match(pattern, filepath.Base(path))
+// posixMode converts Go's FileMode into the traditional st_mode permission bits.
+func posixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
 	}
-
-	// If the pattern starts with '/', it matches from the root
-	if strings.HasPrefix(pattern, "/") {
-		return filepath.Match(pattern[1:], path)
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
 	}
-
-	// Otherwise, try to match the pattern anywhere in the path
-	matched, err := filepath.Match(pattern, path)
-	if matched {
-		return true, nil
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
 	}
+	return bits
+}
 
-	// Also check if the pattern matches any subdirectory
-	parts := strings.Split(path, "/")
-	for i := range parts {
-		subpath := strings.Join(parts[i:], "/")
-		matched, err = filepath.Match(pattern, subpath)
-		if matched {
-			return true, nil
-		}
+// fileModeFromPosix is the inverse of posixMode.
+func fileModeFromPosix(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
 	}
-
-	return false, err
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
 }
 
-func hashFile(filePath string) (FileHashes, error) {
+// hashFile hashes the file at filePath and, if store is set, keeps its chunks there.
+func hashFile(ctx context.Context, filePath string, params ChunkingParams, hasher Hasher, store *chunkStore) (FileHashes, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return FileHashes{}, err
@@ -427,14 +966,36 @@ func hashFile(filePath string) (FileHashes, error) {
 		return FileHashes{}, err
 	}
 
-	totalSize := fileInfo.Size()
-	chunkSize := calculateChunkSize(totalSize)
+	return hashReader(contextReader{ctx, file}, filepath.Base(filePath), fileInfo.Size(), params, hasher, store)
+}
+
+// hashReader chunks and hashes r. Chunk boundaries depend only on the bytes
+// read, never on how the reader happens to split them up; totalSize is the
+// expected size and picks the fixed chunk size. If store is set, every chunk
+// is kept there.
+func hashReader(r io.Reader, name string, totalSize int64, params ChunkingParams, hasher Hasher, store *chunkStore) (FileHashes, error) {
+	result := FileHashes{
+		FileName:  name,
+		Algorithm: hasher.Name(),
+		Chunking:  params.Scheme,
+		TotalSize: totalSize,
+	}
+	if params.Scheme == chunkingFastCDC {
+		result.MinChunkSize = params.MinSize
+		result.AvgChunkSize = params.AvgSize
+		result.MaxChunkSize = params.MaxSize
+	} else {
+		result.ChunkSize = calculateChunkSize(totalSize)
+	}
 
-	hashes := make([]string, 0, maxChunks)
-	buffer := make([]byte, chunkSize)
+	hashes := make([]string, 0, targetChunks)
+	chunks := newChunker(r, params, totalSize)
+	digest := hasher.New()
+	chunkHash := hasher.New()
+	var hashedSize int64
 
 	for {
-		n, err := file.Read(buffer)
+		chunk, err := chunks.Next()
 		if err == io.EOF {
 			break
 		}
@@ -442,25 +1003,32 @@ func hashFile(filePath string) (FileHashes, error) {
 			return FileHashes{}, err
 		}
 
-		hash := blake3.Sum256(buffer[:n])
-		hashes = append(hashes, fmt.Sprintf("%x", hash))
-
-		if len(hashes) >= maxChunks {
-			break
+		chunkHash.Reset()
+		chunkHash.Write(chunk)
+		hash := fmt.Sprintf("%x", chunkHash.Sum(nil))
+		hashes = append(hashes, hash)
+		if store != nil {
+			if err := store.put(hasher.Name(), hash, chunk); err != nil {
+				return FileHashes{}, fmt.Errorf("error storing chunk: %w", err)
+			}
+		}
+		if params.Scheme == chunkingFastCDC {
+			result.ChunkSizes = append(result.ChunkSizes, len(chunk))
 		}
+		digest.Write(chunk)
+		hashedSize += int64(len(chunk))
 	}
 
-	return FileHashes{
-		FileName:   filepath.Base(filePath),
-		ChunkSize:  chunkSize,
-		ChunkCount: len(hashes),
-		Hashes:     hashes,
-		TotalSize:  totalSize,
-	}, nil
+	// Report what was actually hashed; the file may have changed since Stat.
+	result.TotalSize = hashedSize
+	result.ChunkCount = len(hashes)
+	result.Hashes = hashes
+	result.Digest = fmt.Sprintf("%x", digest.Sum(nil))
+	return result, nil
 }
 
 func calculateChunkSize(fileSize int64) int {
-	chunkSize := fileSize / int64(maxChunks)
+	chunkSize := fileSize / int64(targetChunks)
 	if chunkSize < minChunkSize {
 		return minChunkSize
 	}
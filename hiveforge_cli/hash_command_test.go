@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/blake3"
+)
+
+func TestHashOutputStdoutCarriesOnlyTheManifest(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, ".hiveignore"), []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "debug.log"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, status := runCLI(t, "hash", "--no-upload", "--progress", "plain", "--output", "-", root)
+	if status != 0 {
+		t.Fatalf("hash exited with %d:\n%s", status, stderr)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("stdout line is not part of the manifest: %q", line)
+		}
+	}
+	if !strings.Contains(stderr, "Hashing completed!") || !strings.Contains(stderr, "Ignored items: 1") {
+		t.Errorf("summary missing from stderr:\n%s", stderr)
+	}
+
+	stdout, stderr, status = runCLI(t, "hash", "--no-upload", "--output", "-", filepath.Join(root, "missing"))
+	if status != 1 || stdout != "" || !strings.Contains(stderr, "Error hashing directory") {
+		t.Errorf("hashing a missing directory: status %d, stdout %q, stderr %q; want 1, nothing, the error", status, stdout, stderr)
+	}
+}
+
+func TestHashAlgorithmSHA256(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	content := []byte("hello\n")
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := make(map[string]*DirectoryHashResult)
+	for _, algorithm := range []string{algorithmBLAKE3, algorithmSHA256} {
+		stdout, stderr, status := runCLI(t, "hash", "--no-upload", "--quiet", "--algorithm", algorithm, "--output", "-", root)
+		if status != 0 {
+			t.Fatalf("hash --algorithm %s exited with %d:\n%s", algorithm, status, stderr)
+		}
+		var header struct {
+			Record    string `json:"record"`
+			Algorithm string `json:"algorithm"`
+		}
+		line, _, _ := strings.Cut(stdout, "\n")
+		if err := json.Unmarshal([]byte(line), &header); err != nil || header.Record != recordHeader || header.Algorithm != algorithm {
+			t.Errorf("--algorithm %s: manifest header %q, want the algorithm tag", algorithm, line)
+		}
+		sink := newTreeSink()
+		if err := readManifestStream(strings.NewReader(stdout), sink); err != nil {
+			t.Fatal(err)
+		}
+		manifests[algorithm] = &sink.result
+	}
+
+	sum := sha256.Sum256(content)
+	want := hex.EncodeToString(sum[:])
+	file := manifests[algorithmSHA256].DirectoryStructure.Children[0].Hashes
+	if file.Algorithm != algorithmSHA256 || file.Digest != want || len(file.Hashes) != 1 || file.Hashes[0] != want {
+		t.Errorf("sha256 file hashes = %+v, want file and chunk digest %s", file, want)
+	}
+	other := manifests[algorithmBLAKE3].DirectoryStructure.Children[0].Hashes
+	if other.Digest == file.Digest || other.Hashes[0] == file.Hashes[0] {
+		t.Error("blake3 and sha256 manifests share file or chunk digests")
+	}
+	if manifests[algorithmBLAKE3].RootDigest == manifests[algorithmSHA256].RootDigest {
+		t.Error("blake3 and sha256 manifests share a root digest")
+	}
+}
+
+func TestAuthUsesBLAKE3(t *testing.T) {
+	key := blake3.Sum256([]byte("secret"))
+	if got, want := hashKey("secret"), base64.StdEncoding.EncodeToString(key[:]); got != want {
+		t.Errorf("hashKey = %s, want BLAKE3 %s", got, want)
+	}
+	response := blake3.Sum256([]byte("challenge" + "secret"))
+	if got, want := solveChallenge("challenge", "secret"), hex.EncodeToString(response[:]); got != want {
+		t.Errorf("solveChallenge = %s, want BLAKE3 %s", got, want)
+	}
+}
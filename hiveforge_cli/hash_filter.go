@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Kinds of IgnoredItem, so tools can tell why a path is missing without
+// parsing the reason text.
+const (
+	ignoreKindPattern     = "pattern"      // matched an ignore file
+	ignoreKindNotIncluded = "not-included" // outside the --include allowlist
+	ignoreKindMaxSize     = "max-size"     // larger than --max-size
+	ignoreKindSpecial     = "special"      // device, socket or named pipe
+	ignoreKindSymlink     = "symlink"      // skipped by the symlink policy
+	ignoreKindOutput      = "output"       // the manifest being written
+	ignoreKindError       = "error"        // could not be read
+)
+
+func (f HashFilters) empty() bool {
+	return f.MaxSize == 0 && len(f.Include) == 0 && !f.SkipSpecial
+}
+
+// manifestFilters returns the filters to record in a manifest header, or nil
+// if hashing was not filtered.
+func (f HashFilters) manifestFilters() *HashFilters {
+	if f.empty() {
+		return nil
+	}
+	return &f
+}
+
+// compileIncludes turns --include globs into patterns. Unlike ignore files,
+// every glob is relative to the root: "go.*" only matches in the root and
+// "src/**" everything below src.
+func compileIncludes(globs []string) ([]ignorePattern, error) {
+	var patterns []ignorePattern
+	for _, glob := range globs {
+		cleaned := strings.TrimPrefix(path.Clean("/"+strings.TrimSpace(glob)), "/")
+		if cleaned == "" {
+			return nil, fmt.Errorf("invalid include pattern %q", glob)
+		}
+		if err := checkGlob(cleaned); err != nil {
+			return nil, fmt.Errorf("invalid include pattern %q: %w", glob, err)
+		}
+		patterns = append(patterns, ignorePattern{
+			text:     glob,
+			source:   "--include",
+			segments: strings.Split(cleaned, "/"),
+		})
+	}
+	return patterns, nil
+}
+
+// checkGlob returns path.ErrBadPattern for an unterminated bracket or a
+// trailing backslash. Ignore files read those literally, but in a flag they
+// are almost certainly a mistake.
+func checkGlob(glob string) error {
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '[':
+			_, width, ok := matchBracket(glob[i:], 0)
+			if !ok {
+				return path.ErrBadPattern
+			}
+			i += width - 1
+		case '\\':
+			if i+1 == len(glob) {
+				return path.ErrBadPattern
+			}
+			i++
+		}
+	}
+	return nil
+}
+
+// matchInclude returns the include pattern matching relPath, or nil.
+func matchInclude(includes []ignorePattern, relPath string) *ignorePattern {
+	names := strings.Split(relPath, "/")
+	for i := range includes {
+		if matchSegments(includes[i].segments, names) {
+			return &includes[i]
+		}
+	}
+	return nil
+}
+
+// mayIncludeBelow reports whether some include pattern could match a path
+// inside the directory relDir, so the walk has to enter it.
+func mayIncludeBelow(includes []ignorePattern, relDir string) bool {
+	names := strings.Split(relDir, "/")
+	for _, include := range includes {
+		if matchPrefix(include.segments, names) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPrefix reports whether names can be extended to a path matching
+// patterns.
+func matchPrefix(patterns, names []string) bool {
+	for len(names) > 0 {
+		if len(patterns) == 0 {
+			return false
+		}
+		if patterns[0] == "**" {
+			return true
+		}
+		if !matchGlob(patterns[0], names[0]) {
+			return false
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+	return len(patterns) > 0
+}
+
+// specialFileType names the kind of a file that is neither regular, a
+// directory nor a symlink.
+func specialFileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "block device"
+	default:
+		return "special file"
+	}
+}
+
+// parseByteSize parses sizes like "512", "64K", "100MB" or "1.5G". Units are
+// powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(s))
+	number = strings.TrimSuffix(number, "B")
+	multiplier := int64(1)
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			number = number[:len(number)-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"512", 512},
+		{"64K", 64 << 10},
+		{"100MB", 100 << 20},
+		{"1.5g", 3 << 29},
+		{"2T", 2 << 40},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "M", "-1", "ten"} {
+		if _, err := parseByteSize(bad); err == nil {
+			t.Errorf("parseByteSize(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestCompileIncludesRejectsBadGlobs(t *testing.T) {
+	if _, err := compileIncludes([]string{"src/**", "*.[ch]", "[]]x", "docs/[!._]*", `a\*b`}); err != nil {
+		t.Errorf("compileIncludes of valid globs: %v", err)
+	}
+	for _, bad := range []string{"[", "src/[a-", `trailing\`, "/"} {
+		if _, err := compileIncludes([]string{bad}); err == nil {
+			t.Errorf("compileIncludes(%q) succeeded, want an error", bad)
+		} else if bad != "/" && !errors.Is(err, path.ErrBadPattern) {
+			t.Errorf("compileIncludes(%q) = %v, want %v", bad, err, path.ErrBadPattern)
+		}
+	}
+}
+
+func TestHashDirectoryFilters(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]int{
+		"go.mod":            1,
+		"README":            1,
+		"src/a/main.go":     1,
+		"src/big.bin":       4096,
+		"vendor/x/go.mod":   1,
+		"tools/src/tool.go": 1,
+	}
+	for name, size := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var report bytes.Buffer
+	result, err := hashDirectory(context.Background(), root, HashOptions{
+		Chunking:      ChunkingParams{Scheme: chunkingFixed},
+		Hasher:        blake3Hasher{},
+		Jobs:          2,
+		NoCache:       true,
+		Symlinks:      symlinksFollow,
+		Filters:       HashFilters{MaxSize: 1024, Include: []string{"src/**", "go.*"}},
+		IgnoredReport: &report,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.TotalFiles != 2 {
+		t.Errorf("hashed %d files, want go.mod and src/a/main.go", result.TotalFiles)
+	}
+	if result.Filters == nil || result.Filters.MaxSize != 1024 {
+		t.Errorf("manifest filters = %+v, want them recorded", result.Filters)
+	}
+
+	// The manifest only keeps samples; the report lists every path
+	kinds := make(map[string]string)
+	scanner := bufio.NewScanner(&report)
+	for scanner.Scan() {
+		var item IgnoredItem
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(root, item.Path)
+		kinds[filepath.ToSlash(rel)] = item.Kind
+	}
+	want := map[string]string{
+		"README":      ignoreKindNotIncluded,
+		"vendor":      ignoreKindNotIncluded, // pruned without entering it
+		"tools":       ignoreKindNotIncluded,
+		"src/big.bin": ignoreKindMaxSize,
+	}
+	if len(kinds) != len(want) {
+		t.Errorf("ignored %v, want %v", kinds, want)
+	}
+	for name, kind := range want {
+		if kinds[name] != kind {
+			t.Errorf("%s: kind %q, want %q", name, kinds[name], kind)
+		}
+	}
+	if result.Ignored == nil || result.Ignored.Total != len(want) {
+		t.Errorf("manifest summary %+v, want %d ignored items", result.Ignored, len(want))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+)
+
+// fileJob is a file waiting to be hashed. The walk hands the same job to the
+// manifest writer, which waits on done, so records keep walk order no matter
+// which worker finishes first.
+type fileJob struct {
+	path string
+	info os.FileInfo
+	done chan struct{} // closed once entry or err is set
+
+	entry *DirectoryEntry
+	err   error
+}
+
+func newFileJob(path string, info os.FileInfo) *fileJob {
+	return &fileJob{path: path, info: info, done: make(chan struct{})}
+}
+
+// hashPool hashes files on a fixed number of goroutines. The job queue is
+// bounded, so the directory walk can only run a little ahead of hashing.
+type hashPool struct {
+	ctx    context.Context
+	jobs   chan *fileJob
+	wg     sync.WaitGroup
+	opts   HashOptions
+	cache  *hashCache
+	output *HashingOutput
+}
+
+func newHashPool(ctx context.Context, workers int, opts HashOptions, cache *hashCache, output *HashingOutput) *hashPool {
+	if workers < 1 {
+		workers = 1
+	}
+	pool := &hashPool{
+		ctx:    ctx,
+		jobs:   make(chan *fileJob, workers*4),
+		opts:   opts,
+		cache:  cache,
+		output: output,
+	}
+	for i := 0; i < workers; i++ {
+		pool.wg.Add(1)
+		go pool.work()
+	}
+	return pool
+}
+
+func (p *hashPool) submit(job *fileJob) {
+	p.jobs <- job
+}
+
+// wait stops accepting jobs and blocks until every submitted file is hashed.
+func (p *hashPool) wait() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+func (p *hashPool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		if err := p.ctx.Err(); err != nil {
+			// Interrupted: drain the queue without hashing
+			job.err = err
+		} else {
+			job.entry, job.err = processFile(p.ctx, job.path, job.info, p.opts, p.cache, p.output)
+		}
+		if !errors.Is(job.err, context.Canceled) {
+			p.output.updateProgress(job.info.Size())
+		}
+		close(job.done)
+	}
+}
+
+// forEachParallel calls fn for every item on the given number of goroutines.
+// After the first error no further items are started, and that error is
+// returned; if ctx is cancelled, its error is returned instead.
+func forEachParallel[T any](ctx context.Context, items []T, workers int, fn func(context.Context, T) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errMutex sync.Mutex
+		firstErr error
+	)
+	queue := make(chan T)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				if err := fn(runCtx, item); err != nil {
+					errMutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMutex.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, item := range items {
+		select {
+		case queue <- item:
+		case <-runCtx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return firstErr
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// entryOrder lists every entry path of a tree in manifest order.
+func entryOrder(dir string, entry *DirectoryEntry) []string {
+	var order []string
+	for _, child := range entry.Children {
+		childPath := path.Join(dir, child.Name)
+		order = append(order, childPath)
+		order = append(order, entryOrder(childPath, child)...)
+	}
+	return order
+}
+
+func TestHashDirectoryDeterministicAcrossJobs(t *testing.T) {
+	root := t.TempDir()
+	// Sizes vary so that workers finish out of order
+	for i := 0; i < 60; i++ {
+		name := filepath.Join(root, fmt.Sprintf("d%d", i%4), fmt.Sprintf("s%d", i%3), fmt.Sprintf("f%02d.bin", i))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, testData((60-i)*4096+i), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var digests []string
+	var orders [][]string
+	for _, jobs := range []int{1, 8} {
+		result, err := hashDirectory(context.Background(), root, HashOptions{
+			Chunking: testChunkingParams()["fastcdc"],
+			Hasher:   blake3Hasher{},
+			Jobs:     jobs,
+			NoCache:  true,
+			Symlinks: symlinksFollow,
+			Progress: progressNone,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, result.RootDigest)
+		orders = append(orders, entryOrder("", result.DirectoryStructure))
+	}
+	if digests[0] != digests[1] {
+		t.Errorf("root digest with 1 job = %s, with 8 jobs = %s", digests[0], digests[1])
+	}
+	if !reflect.DeepEqual(orders[0], orders[1]) {
+		t.Errorf("child order differs:\n1 job:  %q\n8 jobs: %q", orders[0], orders[1])
+	}
+	if len(orders[0]) != 60+4+12 {
+		t.Errorf("manifest has %d entries, want 76", len(orders[0]))
+	}
+}
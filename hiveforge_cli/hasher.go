@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/blake3"
+)
+
+const (
+	algorithmBLAKE3 = "blake3"
+	algorithmSHA256 = "sha256"
+)
+
+// Hasher produces the digests used for chunks, files and Merkle nodes. Its
+// name is written into manifests so consumers know what they are reading.
+type Hasher interface {
+	Name() string
+	New() hash.Hash
+}
+
+type blake3Hasher struct{}
+
+func (blake3Hasher) Name() string   { return algorithmBLAKE3 }
+func (blake3Hasher) New() hash.Hash { return blake3.New() }
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) Name() string   { return algorithmSHA256 }
+func (sha256Hasher) New() hash.Hash { return sha256.New() }
+
+func newHasher(name string) (Hasher, error) {
+	switch name {
+	case "", algorithmBLAKE3:
+		return blake3Hasher{}, nil
+	case algorithmSHA256, "sha-256":
+		return sha256Hasher{}, nil
+	default:
+		return nil, fmt.Errorf("unknown hash algorithm %q (expected %s or %s)", name, algorithmBLAKE3, algorithmSHA256)
+	}
+}
+
+func sumBytes(h Hasher, data []byte) []byte {
+	d := h.New()
+	d.Write(data)
+	return d.Sum(nil)
+}
+
+func sumHex(h Hasher, data []byte) string {
+	return fmt.Sprintf("%x", sumBytes(h, data))
+}
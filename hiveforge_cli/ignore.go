@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ignoreFileName       = ".hiveignore"
+	gitignoreFileName    = ".gitignore"
+	dockerignoreFileName = ".dockerignore"
+
+	// Names of the optional ignore sources, as recorded in manifests
+	ignoreSourceGit    = "gitignore"
+	ignoreSourceDocker = "dockerignore"
+)
+
+// IgnoreOptions selects the ignore files read besides .hiveignore.
+type IgnoreOptions struct {
+	Gitignore    bool // .gitignore files, including those above the root, and .git/info/exclude
+	Dockerignore bool // .dockerignore in the root
+}
+
+// sources lists the enabled optional sources, for the manifest.
+func (o IgnoreOptions) sources() []string {
+	var sources []string
+	if o.Gitignore {
+		sources = append(sources, ignoreSourceGit)
+	}
+	if o.Dockerignore {
+		sources = append(sources, ignoreSourceDocker)
+	}
+	return sources
+}
+
+func ignoreOptionsFromSources(sources []string) (IgnoreOptions, error) {
+	var opts IgnoreOptions
+	for _, source := range sources {
+		switch source {
+		case ignoreSourceGit:
+			opts.Gitignore = true
+		case ignoreSourceDocker:
+			opts.Dockerignore = true
+		default:
+			return IgnoreOptions{}, fmt.Errorf("unknown ignore source %q", source)
+		}
+	}
+	return opts, nil
+}
+
+// IgnoreRules holds the patterns in effect for one directory, in precedence
+// order. As in git, the last matching pattern decides, so deeper files
+// override shallower ones. Within a directory the files are layered as
+// .gitignore, then .dockerignore, then .hiveignore, so .hiveignore always has
+// the last word.
+type IgnoreRules struct {
+	patterns []ignorePattern
+	opts     IgnoreOptions
+}
+
+// ignorePattern is one compiled line of an ignore file.
+type ignorePattern struct {
+	text   string // the line as written, for reporting
+	source string // the ignore file
+	line   int    // 0 for built-in patterns
+	base   string // directory of the ignore file, relative to the root; "" for the root
+	outer  string // for ignore files above the root: the path from their directory down to the root
+
+	negate   bool     // "!pattern" re-includes what an earlier pattern excluded
+	dirOnly  bool     // "pattern/" only matches directories
+	segments []string // glob segments; unanchored patterns start with "**"
+}
+
+func (p *ignorePattern) origin() string {
+	if p.line == 0 {
+		return p.source
+	}
+	return fmt.Sprintf("%s:%d", p.source, p.line)
+}
+
+// newIgnoreRules returns the rules for rootPath itself: those inherited from
+// an enclosing git repository, if enabled, and the root's own ignore files.
+func newIgnoreRules(rootPath string, opts IgnoreOptions) *IgnoreRules {
+	rules := &IgnoreRules{opts: opts}
+	if opts.Gitignore {
+		rules.patterns = append(rules.patterns, gitRepositoryPatterns(rootPath)...)
+	}
+	return loadIgnoreRules(rootPath, rootPath, rules)
+}
+
+// loadIgnoreRules adds the ignore files in dirPath, if any, to the rules
+// inherited from the parent directory: .gitignore, then .dockerignore in the
+// root, then .hiveignore.
+func loadIgnoreRules(rootPath string, dirPath string, parentRules *IgnoreRules) *IgnoreRules {
+	base, err := filepath.Rel(rootPath, dirPath)
+	if err != nil {
+		return parentRules
+	}
+	base = filepath.ToSlash(base)
+	if base == "." {
+		base = ""
+	}
+
+	var added []ignorePattern
+	if parentRules.opts.Gitignore {
+		added = append(added, readIgnoreFile(filepath.Join(dirPath, gitignoreFileName), base, "", parseIgnorePattern)...)
+	}
+	if parentRules.opts.Dockerignore && base == "" {
+		added = append(added, readIgnoreFile(filepath.Join(dirPath, dockerignoreFileName), "", "", parseDockerignorePattern)...)
+	}
+	added = append(added, readIgnoreFile(filepath.Join(dirPath, ignoreFileName), base, "", parseIgnorePattern)...)
+	if len(added) == 0 {
+		// No ignore files here, the parent's rules apply unchanged
+		return parentRules
+	}
+
+	newRules := &IgnoreRules{
+		patterns: make([]ignorePattern, len(parentRules.patterns), len(parentRules.patterns)+len(added)),
+		opts:     parentRules.opts,
+	}
+	copy(newRules.patterns, parentRules.patterns)
+	newRules.patterns = append(newRules.patterns, added...)
+	return newRules
+}
+
+// readIgnoreFile compiles the patterns of one ignore file. A missing or
+// unreadable file has no patterns.
+func readIgnoreFile(ignoreFilePath, base, outer string, parse func(string) (ignorePattern, bool)) []ignorePattern {
+	file, err := os.Open(ignoreFilePath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		pattern, ok := parse(scanner.Text())
+		if !ok {
+			continue
+		}
+		pattern.source = ignoreFilePath
+		pattern.line = lineNumber
+		pattern.base = base
+		pattern.outer = outer
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// gitRepositoryPatterns finds the git repository containing rootPath and
+// returns what git would apply above the root: .git/info/exclude and the
+// .gitignore files of every directory between the repository's top level
+// and rootPath. The .git directory itself is never hashed.
+func gitRepositoryPatterns(rootPath string) []ignorePattern {
+	patterns := []ignorePattern{{
+		text:     ".git",
+		source:   "built-in rule for --gitignore",
+		segments: []string{"**", ".git"},
+	}}
+
+	root, err := filepath.Abs(rootPath)
+	if err != nil {
+		return patterns
+	}
+	var above []string // directories above the root, nearest first
+	top := root
+	for {
+		if _, err := os.Lstat(filepath.Join(top, ".git")); err == nil {
+			break
+		}
+		parent := filepath.Dir(top)
+		if parent == top {
+			// Not inside a repository
+			return patterns
+		}
+		above = append(above, parent)
+		top = parent
+	}
+
+	outerOf := func(dir string) string {
+		rel, err := filepath.Rel(dir, root)
+		if err != nil || rel == "." {
+			return ""
+		}
+		return filepath.ToSlash(rel)
+	}
+
+	// info/exclude only exists when .git is a directory, not a gitfile
+	patterns = append(patterns,
+		readIgnoreFile(filepath.Join(top, ".git", "info", "exclude"), "", outerOf(top), parseIgnorePattern)...)
+	for i := len(above) - 1; i >= 0; i-- {
+		patterns = append(patterns,
+			readIgnoreFile(filepath.Join(above[i], gitignoreFileName), "", outerOf(above[i]), parseIgnorePattern)...)
+	}
+	return patterns
+}
+
+// parseDockerignorePattern compiles one line of a .dockerignore file. Unlike
+// gitignore, every pattern is relative to the root and trailing slashes carry
+// no meaning.
+func parseDockerignorePattern(line string) (ignorePattern, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+
+	pattern := ignorePattern{text: line}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = strings.TrimSpace(line[1:])
+	}
+	line = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(line)), "/")
+	if line == "" {
+		return ignorePattern{}, false
+	}
+	pattern.segments = strings.Split(line, "/")
+	return pattern, true
+}
+
+// parseIgnorePattern compiles one line of an ignore file following
+// gitignore(5). It reports false for blank lines and comments.
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	line = trimTrailingSpaces(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+
+	pattern := ignorePattern{text: line}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignorePattern{}, false
+	}
+
+	// A slash at the start or in the middle anchors the pattern to the
+	// directory of the ignore file; otherwise it matches at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	for _, segment := range strings.Split(line, "/") {
+		if segment == "" {
+			continue // "a//b" is "a/b"
+		}
+		pattern.segments = append(pattern.segments, segment)
+	}
+	if !anchored {
+		pattern.segments = append([]string{"**"}, pattern.segments...)
+	}
+	return pattern, true
+}
+
+// trimTrailingSpaces removes trailing spaces unless they are escaped with a
+// backslash.
+func trimTrailingSpaces(line string) string {
+	end := len(line)
+	for end > 0 && line[end-1] == ' ' {
+		backslashes := 0
+		for i := end - 2; i >= 0 && line[i] == '\\'; i-- {
+			backslashes++
+		}
+		if backslashes%2 == 1 {
+			break
+		}
+		end--
+	}
+	return line[:end]
+}
+
+// shouldIgnore reports whether path is excluded, and by which pattern.
+func shouldIgnore(path string, isDir bool, rootPath string, rules *IgnoreRules) (IgnoredItem, bool) {
+	relPath, err := filepath.Rel(rootPath, path)
+	if err != nil {
+		return IgnoredItem{}, false
+	}
+
+	// Always use forward slashes for consistency
+	relPath = filepath.ToSlash(relPath)
+
+	pattern := rules.match(relPath, isDir)
+	if pattern == nil || pattern.negate {
+		return IgnoredItem{}, false
+	}
+	return IgnoredItem{
+		Path:    path,
+		Reason:  fmt.Sprintf("Matched pattern '%s' from %s", pattern.text, pattern.origin()),
+		Kind:    ignoreKindPattern,
+		Pattern: pattern.text,
+		Source:  pattern.origin(),
+	}, true
+}
+
+// explainIgnore returns the pattern that decides whether relPath, a
+// slash-separated path relative to rootPath, is hashed. Like hashing, it walks
+// down from the root, so a path inside an excluded directory is excluded by
+// the directory's pattern even if no pattern matches the path itself. The
+// pattern is nil if none matches; ignored is false for a negated pattern.
+func explainIgnore(rootPath string, relPath string, isDir bool, opts IgnoreOptions) (pattern *ignorePattern, ignored bool) {
+	if relPath == "." || relPath == "" {
+		return nil, false // the root is always hashed
+	}
+	rules := newIgnoreRules(rootPath, opts)
+	segments := strings.Split(relPath, "/")
+	for i := range segments {
+		current := strings.Join(segments[:i+1], "/")
+		last := i == len(segments)-1
+		pattern = rules.match(current, isDir || !last)
+		if last {
+			break
+		}
+		if pattern != nil && !pattern.negate {
+			return pattern, true
+		}
+		rules = loadIgnoreRules(rootPath, filepath.Join(rootPath, filepath.FromSlash(current)), rules)
+	}
+	return pattern, pattern != nil && !pattern.negate
+}
+
+// match returns the last pattern matching relPath, a slash-separated path
+// relative to the root, or nil. The caller checks negate.
+func (rules *IgnoreRules) match(relPath string, isDir bool) *ignorePattern {
+	for i := len(rules.patterns) - 1; i >= 0; i-- {
+		pattern := &rules.patterns[i]
+		if pattern.matches(relPath, isDir) {
+			return pattern
+		}
+	}
+	return nil
+}
+
+func (p *ignorePattern) matches(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.outer != "" {
+		relPath = p.outer + "/" + relPath
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(relPath, p.base+"/") {
+			return false
+		}
+		relPath = relPath[len(p.base)+1:]
+	}
+	return matchSegments(p.segments, strings.Split(relPath, "/"))
+}
+
+// matchSegments matches path segments against glob segments, where "**"
+// stands for any number of directories. A trailing "**" needs at least one
+// segment: "dir/**" matches everything inside dir, but not dir itself.
+func matchSegments(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			rest := patterns[1:]
+			if len(rest) == 0 {
+				return len(names) > 0
+			}
+			for skip := 0; skip <= len(names); skip++ {
+				if matchSegments(rest, names[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 || !matchGlob(patterns[0], names[0]) {
+			return false
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// matchGlob matches a single path segment against a glob with "*", "?",
+// bracket expressions and backslash escapes. Runs of "*" act as one.
+func matchGlob(pattern, name string) bool {
+	// Position to retry from after the most recent "*"
+	starPattern, starName := -1, 0
+	p, n := 0, 0
+	for n < len(name) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				for p < len(pattern) && pattern[p] == '*' {
+					p++
+				}
+				starPattern, starName = p, n
+				continue
+			case '?':
+				p++
+				n++
+				continue
+			case '[':
+				if matched, width, ok := matchBracket(pattern[p:], name[n]); ok {
+					if matched {
+						p += width
+						n++
+						continue
+					}
+					break
+				}
+				// An unterminated bracket is a literal "["
+				if name[n] == '[' {
+					p++
+					n++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == name[n] {
+					p += 2
+					n++
+					continue
+				}
+			default:
+				if pattern[p] == name[n] {
+					p++
+					n++
+					continue
+				}
+			}
+		}
+		if starPattern < 0 {
+			return false
+		}
+		starName++
+		p, n = starPattern, starName
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchBracket matches c against the bracket expression at the start of
+// pattern and returns its width. ok is false if the bracket is unterminated.
+func matchBracket(pattern string, c byte) (matched bool, width int, ok bool) {
+	i := 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		negate = true
+		i++
+	}
+
+	first := true
+	for i < len(pattern) {
+		if pattern[i] == ']' && !first {
+			return matched != negate, i + 1, true
+		}
+		first = false
+
+		if pattern[i] == '[' && i+1 < len(pattern) && pattern[i+1] == ':' {
+			if end := strings.Index(pattern[i+2:], ":]"); end >= 0 {
+				if matchCharClass(pattern[i+2:i+2+end], c) {
+					matched = true
+				}
+				i += end + 4
+				continue
+			}
+		}
+
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		i++
+		hi := lo
+		if i+1 < len(pattern) && pattern[i] == '-' && pattern[i+1] != ']' {
+			hi = pattern[i+1]
+			if hi == '\\' && i+2 < len(pattern) {
+				i++
+				hi = pattern[i+1]
+			}
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	return false, 0, false
+}
+
+// matchCharClass implements the POSIX classes gitignore accepts inside
+// brackets, e.g. "[[:digit:]]".
+func matchCharClass(class string, c byte) bool {
+	switch class {
+	case "alnum":
+		return isAlpha(c) || isDigit(c)
+	case "alpha":
+		return isAlpha(c)
+	case "blank":
+		return c == ' ' || c == '\t'
+	case "cntrl":
+		return c < 0x20 || c == 0x7f
+	case "digit":
+		return isDigit(c)
+	case "graph":
+		return c > 0x20 && c < 0x7f
+	case "lower":
+		return c >= 'a' && c <= 'z'
+	case "print":
+		return c >= 0x20 && c < 0x7f
+	case "punct":
+		return c > 0x20 && c < 0x7f && !isAlpha(c) && !isDigit(c)
+	case "space":
+		return c == ' ' || (c >= '\t' && c <= '\r')
+	case "upper":
+		return c >= 'A' && c <= 'Z'
+	case "xdigit":
+		return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+	}
+	return false
+}
+
+func isAlpha(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
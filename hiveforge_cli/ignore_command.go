@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errNothingIgnored makes "ignore check" exit with status 1, as
+// git check-ignore does, when none of the paths is ignored.
+var errNothingIgnored = errors.New("no path is ignored")
+
+// addIgnoreFlags registers the flags selecting the optional ignore files.
+func addIgnoreFlags(fs *flag.FlagSet, config Config) *IgnoreOptions {
+	opts := &IgnoreOptions{}
+	fs.BoolVar(&opts.Gitignore, "gitignore", config.Gitignore, "Also honour .gitignore files and .git/info/exclude")
+	fs.BoolVar(&opts.Dockerignore, "dockerignore", config.Dockerignore, "Also honour .dockerignore in the root")
+	return opts
+}
+
+func handleIgnore(args []string, config Config) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: hiveforgectl ignore [check|ls] ...")
+	}
+
+	switch args[0] {
+	case "check":
+		return handleIgnoreCheck(args[1:], config)
+	case "ls":
+		return handleIgnoreList(args[1:], config)
+	default:
+		return fmt.Errorf("unknown ignore subcommand %q (expected check or ls)", args[0])
+	}
+}
+
+// handleIgnoreCheck prints, for every path, the pattern that decides whether
+// it is hashed in the format of git check-ignore -v -n:
+// "<file>:<line>:<pattern>\t<path>", or "::\t<path>" if no pattern matches.
+// A pattern starting with "!" means the path is hashed.
+func handleIgnoreCheck(args []string, config Config) error {
+	fs := flag.NewFlagSet("ignore check", flag.ContinueOnError)
+	root := fs.String("root", ".", "Directory that would be hashed")
+	opts := addIgnoreFlags(fs, config)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return fmt.Errorf("usage: hiveforgectl ignore check [--root <directory>] [--gitignore] [--dockerignore] <path>...")
+	}
+
+	absRoot, err := filepath.Abs(*root)
+	if err != nil {
+		return err
+	}
+
+	anyIgnored := false
+	for _, arg := range fs.Args() {
+		absPath, err := filepath.Abs(arg)
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(absRoot, absPath)
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s is outside the root %s", arg, *root)
+		}
+
+		// A trailing slash asks about a directory that does not exist
+		isDir := strings.HasSuffix(arg, "/")
+		if info, err := os.Stat(absPath); err == nil {
+			isDir = info.IsDir()
+		}
+
+		pattern, ignored := explainIgnore(*root, filepath.ToSlash(relPath), isDir, *opts)
+		if ignored {
+			anyIgnored = true
+		}
+		if pattern == nil {
+			fmt.Printf("::\t%s\n", arg)
+		} else {
+			fmt.Printf("%s:%s\t%s\n", pattern.origin(), pattern.text, arg)
+		}
+	}
+
+	if !anyIgnored {
+		return errNothingIgnored
+	}
+	return nil
+}
+
+// handleIgnoreList prints every path under a directory that hashing would
+// leave out. Excluded directories are listed with a trailing slash and not
+// entered.
+func handleIgnoreList(args []string, config Config) error {
+	fs := flag.NewFlagSet("ignore ls", flag.ContinueOnError)
+	verbose := fs.Bool("v", false, "Show the deciding pattern for every path")
+	opts := addIgnoreFlags(fs, config)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return fmt.Errorf("usage: hiveforgectl ignore ls [-v] [--gitignore] [--dockerignore] <directory>")
+	}
+
+	rootPath := fs.Arg(0)
+	if _, err := os.ReadDir(rootPath); err != nil {
+		return fmt.Errorf("error reading directory: %w", err)
+	}
+
+	return listIgnored(rootPath, rootPath, ".", newIgnoreRules(rootPath, *opts), func(relPath string, pattern *ignorePattern) {
+		if *verbose {
+			fmt.Printf("%s:%s\t%s\n", pattern.origin(), pattern.text, relPath)
+		} else {
+			fmt.Println(relPath)
+		}
+	})
+}
+
+// listIgnored walks dirPath like hashing does and calls visit for every
+// excluded path. Symlinks to directories are matched as directories, as with
+// the default --symlinks follow, but not entered.
+func listIgnored(rootPath string, dirPath string, relDir string, rules *IgnoreRules, visit func(relPath string, pattern *ignorePattern)) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		childPath := filepath.Join(dirPath, entry.Name())
+		relChild := path.Join(relDir, entry.Name())
+
+		isDir := entry.IsDir()
+		if entry.Type()&os.ModeSymlink != 0 {
+			if info, err := os.Stat(childPath); err == nil {
+				isDir = info.IsDir()
+			}
+		}
+
+		if pattern := rules.match(relChild, isDir); pattern != nil && !pattern.negate {
+			if isDir {
+				relChild += "/"
+			}
+			visit(relChild, pattern)
+			continue
+		}
+
+		if entry.IsDir() {
+			childRules := loadIgnoreRules(rootPath, childPath, rules)
+			if err := listIgnored(rootPath, childPath, relChild, childRules, visit); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Error reading directory %s: %v\n", childPath, err)
+			}
+		}
+	}
+	return nil
+}
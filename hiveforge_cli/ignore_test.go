@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// rulesFor compiles lines as if they were the root .hiveignore.
+func rulesFor(t *testing.T, lines ...string) *IgnoreRules {
+	t.Helper()
+	rules := &IgnoreRules{}
+	for i, line := range lines {
+		pattern, ok := parseIgnorePattern(line)
+		if !ok {
+			continue
+		}
+		pattern.source, pattern.line = ignoreFileName, i+1
+		rules.patterns = append(rules.patterns, pattern)
+	}
+	return rules
+}
+
+func ignored(rules *IgnoreRules, relPath string, isDir bool) bool {
+	pattern := rules.match(relPath, isDir)
+	return pattern != nil && !pattern.negate
+}
+
+// The cases follow the PATTERN FORMAT section and examples of gitignore(5).
+func TestIgnorePatternConformance(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		// Blank lines and comments
+		{"blank line", []string{""}, "a", false, false},
+		{"comment", []string{"#a"}, "#a", false, false},
+		{"escaped hash", []string{`\#a`}, "#a", false, true},
+
+		// Trailing spaces are ignored unless escaped
+		{"trailing spaces", []string{"a.txt   "}, "a.txt", false, true},
+		{"escaped trailing space", []string{`a\ `}, "a ", false, true},
+		{"escaped trailing space needs space", []string{`a\ `}, "a", false, false},
+		{"CRLF line ending", []string{"a.txt\r"}, "a.txt", false, true},
+
+		// Negation
+		{"negation re-includes", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"negation keeps others", []string{"*.log", "!keep.log"}, "drop.log", false, true},
+		{"last match wins", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"escaped bang", []string{`\!important`}, "!important", false, true},
+
+		// A trailing slash only matches directories
+		{"dir pattern matches dir", []string{"frotz/"}, "frotz", true, true},
+		{"dir pattern skips file", []string{"frotz/"}, "frotz", false, false},
+		{"dir pattern at depth", []string{"frotz/"}, "a/frotz", true, true},
+		{"dir pattern with middle slash", []string{"doc/frotz/"}, "doc/frotz", true, true},
+		{"dir pattern with middle slash is anchored", []string{"doc/frotz/"}, "a/doc/frotz", true, false},
+
+		// Without a slash a pattern matches at any level
+		{"basename at root", []string{"foo"}, "foo", false, true},
+		{"basename at depth", []string{"foo"}, "a/b/foo", false, true},
+		{"basename matches dirs", []string{"foo"}, "a/foo", true, true},
+
+		// A leading or middle slash anchors to the ignore file's directory
+		{"leading slash", []string{"/foo"}, "foo", false, true},
+		{"leading slash not at depth", []string{"/foo"}, "a/foo", false, false},
+		{"middle slash", []string{"doc/frotz"}, "doc/frotz", false, true},
+		{"middle slash not at depth", []string{"doc/frotz"}, "a/doc/frotz", false, false},
+		{"anchored glob", []string{"/*.c"}, "cat-file.c", false, true},
+		{"anchored glob not at depth", []string{"/*.c"}, "mozilla-sha1/sha1.c", false, false},
+
+		// Wildcards do not cross slashes
+		{"star", []string{"*.html"}, "docs/index.html", false, true},
+		{"star does not cross slash", []string{"foo/*"}, "foo/bar/hello.c", false, false},
+		{"star matches one level", []string{"foo/*"}, "foo/test.json", false, true},
+		{"star matches directories", []string{"foo/*"}, "foo/bar", true, true},
+		{"question mark", []string{"?.txt"}, "a.txt", false, true},
+		{"question mark is one char", []string{"?.txt"}, "ab.txt", false, false},
+		{"star matches empty", []string{"a*"}, "a", false, true},
+		{"consecutive stars in a segment", []string{"a**b"}, "axxb", false, true},
+		{"consecutive stars do not cross slash", []string{"a**b"}, "a/b", false, false},
+
+		// Double asterisks
+		{"leading double star", []string{"**/foo"}, "foo", false, true},
+		{"leading double star at depth", []string{"**/foo"}, "a/b/foo", false, true},
+		{"leading double star with path", []string{"**/foo/bar"}, "x/foo/bar", false, true},
+		{"leading double star dir", []string{"**/.cache/"}, "a/.cache", true, true},
+		{"leading double star dir skips file", []string{"**/.cache/"}, "a/.cache", false, false},
+		{"trailing double star", []string{"abc/**"}, "abc/x", false, true},
+		{"trailing double star deep", []string{"abc/**"}, "abc/x/y", false, true},
+		{"trailing double star not dir itself", []string{"abc/**"}, "abc", true, false},
+		{"middle double star none", []string{"a/**/b"}, "a/b", false, true},
+		{"middle double star one", []string{"a/**/b"}, "a/x/b", false, true},
+		{"middle double star many", []string{"a/**/b"}, "a/x/y/b", false, true},
+		{"middle double star anchored", []string{"a/**/b"}, "z/a/b", false, false},
+
+		// Bracket expressions
+		{"bracket set", []string{"[abc].txt"}, "b.txt", false, true},
+		{"bracket set miss", []string{"[abc].txt"}, "d.txt", false, false},
+		{"bracket range", []string{"file[0-9]"}, "file7", false, true},
+		{"bracket range miss", []string{"file[0-9]"}, "filex", false, false},
+		{"bracket bang negation", []string{"[!a].txt"}, "b.txt", false, true},
+		{"bracket bang negation miss", []string{"[!a].txt"}, "a.txt", false, false},
+		{"bracket caret negation", []string{"[^a].txt"}, "a.txt", false, false},
+		{"bracket leading close", []string{"[]x]"}, "]", false, true},
+		{"bracket class", []string{"[[:digit:]].log"}, "7.log", false, true},
+		{"bracket class miss", []string{"[[:digit:]].log"}, "x.log", false, false},
+		{"bracket class combined", []string{"[[:upper:]_]*"}, "_tmp", false, true},
+		{"bracket does not match slash", []string{"a[/]b"}, "a/b", false, false},
+		{"unterminated bracket is literal", []string{"a["}, "a[", false, true},
+
+		// Backslash escapes
+		{"escaped star", []string{`\*.txt`}, "*.txt", false, true},
+		{"escaped star is literal", []string{`\*.txt`}, "a.txt", false, false},
+		{"escaped question mark", []string{`what\?`}, "what?", false, true},
+		{"escaped bracket", []string{`\[a]`}, "[a]", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := rulesFor(t, tt.patterns...)
+			if got := ignored(rules, tt.path, tt.isDir); got != tt.want {
+				t.Errorf("patterns %q, path %q (dir %v): ignored = %v, want %v", tt.patterns, tt.path, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func writeIgnoreFile(t *testing.T, dir string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ignoreFileName), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNestedIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	writeIgnoreFile(t, root, "*.log\n/build\n")
+	writeIgnoreFile(t, filepath.Join(root, "src"), "# patterns are relative to src/\n/build\ngen/*.go\n!keep.log\n")
+
+	rootRules := loadIgnoreRules(root, root, &IgnoreRules{})
+	srcRules := loadIgnoreRules(root, filepath.Join(root, "src"), rootRules)
+
+	tests := []struct {
+		rules *IgnoreRules
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{rootRules, "build", true, true},
+		{rootRules, "a/build", true, false},
+		{srcRules, "src/build", true, true},
+		{srcRules, "src/a/build", true, false},
+		{srcRules, "src/gen/x.go", false, true},
+		{rootRules, "gen/x.go", false, false},
+		{srcRules, "src/debug.log", false, true},
+		{srcRules, "src/keep.log", false, false}, // a deeper file overrides its parent
+		{srcRules, "src/main.go", false, false},
+	}
+	for _, tt := range tests {
+		item, got := shouldIgnore(filepath.Join(root, tt.path), tt.isDir, root, tt.rules)
+		if got != tt.want {
+			t.Errorf("%s: ignored = %v (%s), want %v", tt.path, got, item.Reason, tt.want)
+		}
+	}
+
+	item, _ := shouldIgnore(filepath.Join(root, "src", "gen", "x.go"), false, root, srcRules)
+	want := "Matched pattern 'gen/*.go' from " + filepath.Join(root, "src", ignoreFileName) + ":3"
+	if item.Reason != want {
+		t.Errorf("reason = %q, want %q", item.Reason, want)
+	}
+	if item.Kind != ignoreKindPattern || item.Pattern != "gen/*.go" || item.Source != filepath.Join(root, "src", ignoreFileName)+":3" {
+		t.Errorf("item = %+v, want the structured pattern and source", item)
+	}
+}
+
+func TestHashDirectoryAppliesIgnoreRules(t *testing.T) {
+	root := t.TempDir()
+	writeIgnoreFile(t, root, "**/.cache/\n*.log\n!keep.log\n")
+	for _, name := range []string{"a/.cache/blob", "a/b/.cache/blob", "a/debug.log", "a/keep.log", "a/main.go"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := hashDirectory(context.Background(), root, HashOptions{
+		Chunking: ChunkingParams{Scheme: chunkingFixed},
+		Hasher:   blake3Hasher{},
+		Jobs:     2,
+		NoCache:  true,
+		Symlinks: symlinksFollow,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	var collect func(prefix string, entry *DirectoryEntry)
+	collect = func(prefix string, entry *DirectoryEntry) {
+		for _, child := range entry.Children {
+			childPath := prefix + child.Name
+			if child.Type == "directory" {
+				collect(childPath+"/", child)
+			} else {
+				files = append(files, childPath)
+			}
+		}
+	}
+	collect("", result.DirectoryStructure)
+
+	want := []string{ignoreFileName, "a/keep.log", "a/main.go"}
+	if len(files) != len(want) {
+		t.Fatalf("hashed %q, want %q", files, want)
+	}
+	for i := range want {
+		if files[i] != want[i] {
+			t.Fatalf("hashed %q, want %q", files, want)
+		}
+	}
+}
+
+func TestGitignoreLayering(t *testing.T) {
+	repo := t.TempDir()
+	root := filepath.Join(repo, "services", "api")
+	writeFile := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(repo, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(".git/info/exclude", "*.swp\n")
+	writeFile(".gitignore", "*.log\n/services/api/vendor/\n")
+	writeFile("services/api/.gitignore", "dist/\n!secrets\n")
+	writeFile("services/api/.hiveignore", "!keep.log\n")
+	writeFile("services/api/.dockerignore", "*.md\n!README.md\nsecrets\n")
+
+	tests := []struct {
+		opts  IgnoreOptions
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{IgnoreOptions{}, "debug.log", false, false},
+		{IgnoreOptions{Gitignore: true}, "debug.log", false, true}, // repository root .gitignore
+		{IgnoreOptions{Gitignore: true}, "a/b.swp", false, true},   // .git/info/exclude
+		{IgnoreOptions{Gitignore: true}, "vendor", true, true},     // anchored in the repository root
+		{IgnoreOptions{Gitignore: true}, "x/vendor", true, false},
+		{IgnoreOptions{Gitignore: true}, "dist", true, true},         // the root's own .gitignore
+		{IgnoreOptions{Gitignore: true}, "keep.log", false, false},   // .hiveignore has the last word
+		{IgnoreOptions{Gitignore: true}, ".git", true, true},         // never hashed with --gitignore
+		{IgnoreOptions{Dockerignore: true}, "NOTES.md", false, true}, // .dockerignore
+		{IgnoreOptions{Dockerignore: true}, "README.md", false, false},
+		{IgnoreOptions{Dockerignore: true}, "docs/a.md", false, false}, // docker patterns are root-anchored
+		{IgnoreOptions{Dockerignore: true}, "secrets", true, true},
+		// .dockerignore comes after the root's .gitignore and overrides its negation
+		{IgnoreOptions{Gitignore: true, Dockerignore: true}, "secrets", true, true},
+	}
+	for _, tt := range tests {
+		rules := newIgnoreRules(root, tt.opts)
+		item, got := shouldIgnore(filepath.Join(root, filepath.FromSlash(tt.path)), tt.isDir, root, rules)
+		if got != tt.want {
+			t.Errorf("%+v %s: ignored = %v (%s), want %v", tt.opts, tt.path, got, item.Reason, tt.want)
+		}
+	}
+
+	rules := newIgnoreRules(root, IgnoreOptions{Gitignore: true})
+	item, _ := shouldIgnore(filepath.Join(root, "debug.log"), false, root, rules)
+	want := "Matched pattern '*.log' from " + filepath.Join(repo, gitignoreFileName) + ":1"
+	if item.Reason != want {
+		t.Errorf("reason = %q, want %q", item.Reason, want)
+	}
+}
+
+func TestExplainIgnore(t *testing.T) {
+	root := t.TempDir()
+	writeIgnoreFile(t, root, "build/\n*.log\n!keep.log\n")
+	writeIgnoreFile(t, filepath.Join(root, "src"), "gen/\n!build/\n")
+
+	tests := []struct {
+		path        string
+		isDir       bool
+		wantPattern string // "" for no match
+		wantIgnored bool
+	}{
+		{"main.go", false, "", false},
+		{"debug.log", false, "*.log", true},
+		{"keep.log", false, "!keep.log", false},
+		{"build", true, "build/", true},
+		{"build/out/app", false, "build/", true}, // excluded with its parent
+		{"src/gen/a.go", false, "gen/", true},    // from src/.hiveignore
+		{"src/build", true, "!build/", false},
+	}
+	for _, tt := range tests {
+		pattern, ignored := explainIgnore(root, tt.path, tt.isDir, IgnoreOptions{})
+		got := ""
+		if pattern != nil {
+			got = pattern.text
+		}
+		if got != tt.wantPattern || ignored != tt.wantIgnored {
+			t.Errorf("%s: pattern %q, ignored %v; want %q, %v", tt.path, got, ignored, tt.wantPattern, tt.wantIgnored)
+		}
+	}
+}
+
+func TestListIgnored(t *testing.T) {
+	root := t.TempDir()
+	writeIgnoreFile(t, root, "build/\n*.log\n!keep.log\n")
+	for _, name := range []string{"build/app", "a/debug.log", "a/keep.log", "a/main.go"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	err := listIgnored(root, root, ".", newIgnoreRules(root, IgnoreOptions{}), func(relPath string, pattern *ignorePattern) {
+		got = append(got, relPath)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a/debug.log", "build/"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("listed %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	ignoredSamples         = 5 // sample paths kept per group
+	terminalIgnoredSamples = 3 // of which the summary prints this many
+	terminalIgnoredGroups  = 20
+	manifestIgnoredGroups  = 100 // groups sent in a manifest, largest first
+)
+
+// ignoredCollector groups ignored items by the rule that excluded them, so
+// memory and output stay bounded when a rule matches thousands of paths,
+// e.g. node_modules. Every item can additionally be streamed to a report.
+type ignoredCollector struct {
+	total  int
+	groups map[ignoredGroupKey]*IgnoredGroup
+	order  []*IgnoredGroup // first seen first, to break ties
+
+	report *json.Encoder // write errors surface when the caller flushes it
+}
+
+type ignoredGroupKey struct {
+	kind, pattern, source string
+}
+
+func newIgnoredCollector(report io.Writer) *ignoredCollector {
+	c := &ignoredCollector{groups: make(map[ignoredGroupKey]*IgnoredGroup)}
+	if report != nil {
+		c.report = json.NewEncoder(report)
+	}
+	return c
+}
+
+func (c *ignoredCollector) add(item IgnoredItem) {
+	c.total++
+	if c.report != nil {
+		c.report.Encode(item)
+	}
+
+	key := ignoredGroupKey{item.Kind, item.Pattern, item.Source}
+	group := c.groups[key]
+	if group == nil {
+		group = &IgnoredGroup{
+			Kind:    item.Kind,
+			Pattern: item.Pattern,
+			Source:  item.Source,
+			Reason:  ignoredGroupReason(item),
+		}
+		c.groups[key] = group
+		c.order = append(c.order, group)
+	}
+	group.Count++
+	if len(group.Samples) < ignoredSamples {
+		sample := item.Path
+		if item.Reason != group.Reason {
+			// Errors and broken links differ per path
+			sample = fmt.Sprintf("%s (%s)", item.Path, item.Reason)
+		}
+		group.Samples = append(group.Samples, sample)
+	}
+}
+
+// ignoredGroupReason describes what the items of a group have in common.
+func ignoredGroupReason(item IgnoredItem) string {
+	switch item.Kind {
+	case ignoreKindPattern:
+		return item.Reason
+	case ignoreKindNotIncluded:
+		return "Not matched by any --include pattern"
+	case ignoreKindMaxSize:
+		return "Larger than --max-size"
+	case ignoreKindSpecial:
+		return "Special files"
+	case ignoreKindSymlink:
+		return "Skipped symlinks"
+	case ignoreKindOutput:
+		return "Skipped manifest output file"
+	case ignoreKindError:
+		return "Errors"
+	default:
+		return item.Reason
+	}
+}
+
+// summary returns at most limit groups, the largest first.
+func (c *ignoredCollector) summary(limit int) *IgnoredSummary {
+	if c.total == 0 {
+		return nil
+	}
+	groups := make([]IgnoredGroup, len(c.order))
+	for i, group := range c.order {
+		groups[i] = *group
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Count > groups[j].Count })
+
+	summary := &IgnoredSummary{Total: c.total, Groups: groups}
+	if len(groups) > limit {
+		summary.Groups = groups[:limit]
+		summary.OmittedGroups = len(groups) - limit
+	}
+	return summary
+}
+
+// summarizeIgnoredItems builds the bounded summary for a manifest that still
+// lists every ignored item.
+func summarizeIgnoredItems(items []IgnoredItem) *IgnoredSummary {
+	collector := newIgnoredCollector(nil)
+	for _, item := range items {
+		collector.add(item)
+	}
+	return collector.summary(manifestIgnoredGroups)
+}
+
+func printIgnoredSummary(out io.Writer, summary *IgnoredSummary) {
+	if summary == nil {
+		return
+	}
+	fmt.Fprintf(out, "\nIgnored items: %d, grouped by rule:\n", summary.Total)
+	for _, group := range summary.Groups {
+		fmt.Fprintf(out, "  %7d  %s\n", group.Count, group.Reason)
+		shown := group.Samples
+		if len(shown) > terminalIgnoredSamples {
+			shown = shown[:terminalIgnoredSamples]
+		}
+		for _, sample := range shown {
+			fmt.Fprintf(out, "           %s\n", sample)
+		}
+		if more := group.Count - len(shown); more > 0 {
+			fmt.Fprintf(out, "           ... and %d more\n", more)
+		}
+	}
+	if summary.OmittedGroups > 0 {
+		fmt.Fprintf(out, "  ... and %d more rules; use --ignored-report for the full list\n", summary.OmittedGroups)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestIgnoredCollectorGroupsByRule(t *testing.T) {
+	var report bytes.Buffer
+	collector := newIgnoredCollector(&report)
+	for i := 0; i < 1000; i++ {
+		collector.add(IgnoredItem{
+			Path:    fmt.Sprintf("node_modules/pkg%d", i),
+			Reason:  "Matched pattern 'node_modules/' from .hiveignore:1",
+			Kind:    ignoreKindPattern,
+			Pattern: "node_modules/",
+			Source:  ".hiveignore:1",
+		})
+	}
+	collector.add(IgnoredItem{Path: "a", Kind: ignoreKindError, Reason: "Error getting file info: denied"})
+	collector.add(IgnoredItem{Path: "b", Kind: ignoreKindError, Reason: "Error reading symlink: gone"})
+
+	summary := collector.summary(manifestIgnoredGroups)
+	if summary.Total != 1002 || len(summary.Groups) != 2 {
+		t.Fatalf("summary = %+v, want 1002 items in 2 groups", summary)
+	}
+	patterns, errors := summary.Groups[0], summary.Groups[1]
+	if patterns.Count != 1000 || len(patterns.Samples) != ignoredSamples || patterns.Pattern != "node_modules/" {
+		t.Errorf("pattern group = %+v", patterns)
+	}
+	if errors.Count != 2 || errors.Samples[0] != "a (Error getting file info: denied)" {
+		t.Errorf("error group = %+v, want the per-path reason in the samples", errors)
+	}
+
+	if lines := strings.Count(report.String(), "\n"); lines != 1002 {
+		t.Errorf("report has %d lines, want every item", lines)
+	}
+
+	limited := collector.summary(1)
+	if len(limited.Groups) != 1 || limited.OmittedGroups != 1 || limited.Groups[0].Count != 1000 {
+		t.Errorf("limited summary = %+v, want the largest group only", limited)
+	}
+}
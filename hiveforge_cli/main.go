@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	// "crypto/hmac"
 	"encoding/base64"
 	"encoding/json"
@@ -32,6 +33,16 @@ type Config struct {
 	Debug       bool   `json:"debug"`
 	ApiKey      string `json:"api_key"`
 	MasterKey   string `json:"master_key"`
+
+	HashAlgorithm string `json:"hash_algorithm"` // default for hash: blake3 or sha256
+	Gitignore     bool   `json:"gitignore"`      // default for hash --gitignore
+	Dockerignore  bool   `json:"dockerignore"`   // default for hash --dockerignore
+
+	ChunkStoreDir     string `json:"cas_dir"`      // local chunk store, default ~/.hiveforge/cas
+	ChunkStoreMaxSize string `json:"cas_max_size"` // e.g. "20G"; default 10G, "0" for no limit
+	StoreChunks       bool   `json:"store_chunks"` // default for hash --store-chunks
+	// zstd level 1-22 for chunk transfers; 0 for the default (3), -1 for no compression
+	ChunkCompressionLevel int `json:"chunk_compression_level"`
 }
 
 type ApiKey struct {
@@ -103,9 +114,6 @@ func loadConfig() (Config, *JWT, error) {
 		}
 	}
 
-	fmt.Printf("Debug: Loaded config - ApiKey set: %v, MasterKey set: %v\n",
-		config.ApiKey != "", config.MasterKey != "")
-
 	for _, path := range jwtPaths {
 		if _, err := os.Stat(path); err == nil {
 			file, err := os.ReadFile(path)
@@ -353,6 +361,22 @@ func printRequest(req *http.Request, body []byte) {
 
 // Use the JWT to make an authenticated request to the API
 func makeAuthenticatedRequest(config Config, jwt *JWT, method, url string, body []byte, contentEncoding string) (*http.Response, error) {
+	req, err := newAuthenticatedRequest(config, jwt, method, url, bytes.NewBuffer(body), "application/json", contentEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Debug {
+		printRequest(req, body)
+	}
+
+	client := &http.Client{}
+	return client.Do(req)
+}
+
+// newAuthenticatedRequest refreshes the JWT if needed and prepares a request
+// with a streamed body.
+func newAuthenticatedRequest(config Config, jwt *JWT, method, url string, body io.Reader, contentType, contentEncoding string) (*http.Request, error) {
 	needsRefresh := func(jwt *JWT) bool {
 		if jwt == nil {
 			return true
@@ -384,21 +408,15 @@ func makeAuthenticatedRequest(config Config, jwt *JWT, method, url string, body
 		}
 	}
 
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", jwt.Token))
 	req.Header.Set("Content-Encoding", contentEncoding)
-
-	if config.Debug {
-		printRequest(req, body)
-	}
-
-	client := &http.Client{}
-	return client.Do(req)
+	return req, nil
 }
 
 func listApiKeys(config Config, jwt *JWT) ([]ApiKey, error) {
@@ -740,7 +758,7 @@ func main() {
 
 	config, jwt, err := loadConfig()
 	if err != nil {
-		fmt.Println("Error loading config:", err)
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
 		return
 	}
 	config.Debug = *debug
@@ -754,8 +772,53 @@ func main() {
 			config.ApiKey != "", config.MasterKey != "")
 	}
 
-	if config.MasterKey == "" && config.ApiKey == "" {
-		fmt.Println("Error: Neither master key nor API key is set in the configuration. At least one is required.")
+	// Local commands do not talk to the controller and need no credentials
+	switch args[0] {
+	case "verify":
+		if err := handleVerify(args[1:], config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error verifying directory: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "diff":
+		// Only snapshot:ID arguments reach the controller
+		if err := handleDiff(args[1:], config, jwt); err != nil {
+			fmt.Fprintf(os.Stderr, "Error comparing manifests: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "ignore":
+		if err := handleIgnore(args[1:], config); err != nil {
+			if errors.Is(err, errNothingIgnored) {
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "Error checking ignore rules: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "cache":
+		// Only snapshot:ID arguments to cache gc --keep reach the controller
+		if err := handleCache(args[1:], config, jwt); err != nil {
+			if !errors.Is(err, errCorruptChunks) {
+				fmt.Fprintf(os.Stderr, "Error managing chunk store: %v\n", err)
+			}
+			os.Exit(1)
+		}
+		return
+	case "hash":
+		// Checks credentials itself, unless the manifest is not uploaded
+		if err := handleHash(args[1:], config, jwt); err != nil {
+			fmt.Fprintf(os.Stderr, "Error hashing directory: %v\n", err)
+			if errors.Is(err, context.Canceled) {
+				os.Exit(130) // as if killed by SIGINT
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := checkCredentials(config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		return
 	}
 
@@ -764,10 +827,26 @@ func main() {
 		handleAuthenticate(config)
 	case "get":
 		handleGet(args[1:], config, jwt)
-	case "hash":
-		err := handleHash(args[1:], config, jwt)
-		if err != nil {
-			fmt.Printf("Error hashing directory: %v\n", err)
+	case "upload":
+		if err := handleUpload(args[1:], config, jwt); err != nil {
+			fmt.Fprintf(os.Stderr, "Error uploading manifest: %v\n", err)
+			os.Exit(1)
+		}
+	case "push":
+		if err := handlePush(args[1:], config, jwt); err != nil {
+			fmt.Fprintf(os.Stderr, "Error pushing chunks: %v\n", err)
+			if errors.Is(err, context.Canceled) {
+				os.Exit(130)
+			}
+			os.Exit(1)
+		}
+	case "restore":
+		if err := handleRestore(args[1:], config, jwt); err != nil {
+			fmt.Fprintf(os.Stderr, "Error restoring snapshot: %v\n", err)
+			if errors.Is(err, context.Canceled) {
+				os.Exit(130)
+			}
+			os.Exit(1)
 		}
 	case "create":
 		handleCreate(args[1:], config, jwt)
@@ -783,12 +862,30 @@ func main() {
 	}
 }
 
+// checkCredentials reports whether config can authenticate to the controller.
+func checkCredentials(config Config) error {
+	if config.MasterKey == "" && config.ApiKey == "" {
+		return fmt.Errorf("Neither master key nor API key is set in the configuration. At least one is required.")
+	}
+	return nil
+}
+
 func printUsage() {
 	fmt.Println("Usage: hiveforgectl [command] [subcommand] [args...] [-d|--debug]")
 	fmt.Println("Commands:")
 	fmt.Println("  authenticate")
 	fmt.Println("  get [jobs|agents]")
-	fmt.Println("  hash <directory>")
+	fmt.Println("  hash [--algorithm blake3|sha256] [--chunking fixed|fastcdc] [--jobs N] [--no-cache] [--symlinks skip|record|follow] [--gitignore] [--dockerignore] [--max-size SIZE] [--include GLOB]... [--skip-special] [--ignored-report <path>] [--store-chunks] [--progress auto|bar|plain|json] [--quiet] [--resume] [--output <path|->] [--no-upload] [--dry-run] [--push [--upload-jobs N]] <directory>")
+	fmt.Println("  upload <manifest>")
+	fmt.Println("  push [--jobs N] [--progress auto|bar|plain|json] [--quiet] <snapshot-id> <directory>")
+	fmt.Println("  restore [--jobs N] [--store <dir>] [--no-store] [--force] [--progress auto|bar|plain|json] [--quiet] <snapshot-id> <destination>")
+	fmt.Println("  verify [--jobs N] [--progress auto|bar|plain|json] [--quiet] <directory> <manifest.json>")
+	fmt.Println("  ignore check [--root <directory>] [--gitignore] [--dockerignore] <path>...")
+	fmt.Println("  ignore ls [-v] [--gitignore] [--dockerignore] <directory>")
+	fmt.Println("  diff [--format text|json] <old.json|snapshot:ID> <new.json|snapshot:ID>")
+	fmt.Println("  cache gc [--max-size SIZE] [--keep <manifest|snapshot:ID>]... [--unreferenced] [--dry-run]")
+	fmt.Println("  cache fsck [--delete]")
+	fmt.Println("  cache stats")
 	fmt.Println("  create job <json_file>")
 	fmt.Println("  describe [job|agent] <id>")
 	fmt.Println("  generate-key <type> <name> <description>")
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// snapshotPrefix marks a manifest argument that names a hash result stored
+// on the controller instead of a local file, e.g. "snapshot:42".
+const snapshotPrefix = "snapshot:"
+
+// readManifest loads a DirectoryHashResult previously written by hash.
+func readManifest(path string) (*DirectoryHashResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeManifest(data, path)
+}
+
+// loadManifest reads a local manifest file or fetches a stored snapshot.
+func loadManifest(source string, config Config, jwt *JWT) (*DirectoryHashResult, error) {
+	if id, ok := strings.CutPrefix(source, snapshotPrefix); ok {
+		return fetchSnapshot(config, jwt, id)
+	}
+	return readManifest(source)
+}
+
+// decodeManifest accepts both a streamed (NDJSON) manifest and the single
+// JSON document older clients wrote.
+func decodeManifest(data []byte, source string) (*DirectoryHashResult, error) {
+	var result DirectoryHashResult
+	if isManifestStream(data) {
+		sink := newTreeSink()
+		if err := readManifestStream(bytes.NewReader(data), sink); err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %w", source, err)
+		}
+		result = sink.result
+	} else if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", source, err)
+	}
+	if result.DirectoryStructure == nil {
+		return nil, fmt.Errorf("invalid manifest %s: no directory structure", source)
+	}
+
+	// Manifests from before these fields existed were always produced this way
+	if result.Algorithm == "" {
+		result.Algorithm = algorithmBLAKE3
+	}
+	if result.Chunking.Scheme == "" {
+		result.Chunking.Scheme = chunkingFixed
+	}
+	if result.Symlinks == "" {
+		result.Symlinks = symlinksFollow
+	}
+	return &result, nil
+}
+
+// chunkSizes returns the length of each chunk of a file, in order.
+func chunkSizes(hashes *FileHashes) []int64 {
+	sizes := make([]int64, len(hashes.Hashes))
+	if len(hashes.ChunkSizes) == len(hashes.Hashes) {
+		for i, size := range hashes.ChunkSizes {
+			sizes[i] = int64(size)
+		}
+		return sizes
+	}
+
+	remaining := hashes.TotalSize
+	for i := range sizes {
+		size := int64(hashes.ChunkSize)
+		if size > remaining || i == len(sizes)-1 {
+			size = remaining
+		}
+		sizes[i] = size
+		remaining -= size
+	}
+	return sizes
+}
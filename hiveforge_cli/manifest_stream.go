@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+)
+
+// A streamed manifest is NDJSON: a header record, one entry record per file,
+// symlink and directory in post-order (children before their directory, the
+// root directory "." last), and a trailer with the totals. Entries carry their
+// path relative to the root, so a reader never needs the whole tree at once.
+const (
+	manifestVersion = 1
+
+	recordHeader  = "header"
+	recordEntry   = "entry"
+	recordTrailer = "trailer"
+)
+
+type manifestHeader struct {
+	Record         string         `json:"record"`
+	Version        int            `json:"version"`
+	RootPath       string         `json:"root"`
+	Algorithm      string         `json:"algorithm"`
+	Chunking       ChunkingParams `json:"chunking"`
+	Symlinks       string         `json:"symlinks,omitempty"`
+	SymlinksEscape bool           `json:"symlinksEscape,omitempty"`
+	IgnoreSources  []string       `json:"ignoreSources,omitempty"`
+	Filters        *HashFilters   `json:"filters,omitempty"`
+}
+
+// manifestEntry is a DirectoryEntry without children plus its path.
+type manifestEntry struct {
+	Record string `json:"record"`
+	Path   string `json:"path"`
+	*DirectoryEntry
+}
+
+type manifestTrailer struct {
+	Record       string          `json:"record"`
+	RootDigest   string          `json:"rootDigest"`
+	TotalSize    int64           `json:"size"`
+	TotalFiles   int             `json:"files"`
+	HashingTime  float64         `json:"time"`
+	Ignored      *IgnoredSummary `json:"ignored,omitempty"`
+	IgnoredItems []IgnoredItem   `json:"ignoredItems,omitempty"` // older versions listed every item
+}
+
+// manifestSink receives a manifest as it is produced. Entries arrive in
+// post-order and must not be modified by the sink's caller afterwards.
+type manifestSink interface {
+	writeHeader(header manifestHeader) error
+	writeEntry(path string, entry *DirectoryEntry) error
+	writeTrailer(trailer manifestTrailer) error
+}
+
+// ndjsonSink encodes records to w, one per line.
+type ndjsonSink struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newNDJSONSink(w io.Writer) *ndjsonSink {
+	buffered := bufio.NewWriter(w)
+	return &ndjsonSink{w: buffered, encoder: json.NewEncoder(buffered)}
+}
+
+func (s *ndjsonSink) writeHeader(header manifestHeader) error {
+	header.Record, header.Version = recordHeader, manifestVersion
+	return s.encoder.Encode(header)
+}
+
+func (s *ndjsonSink) writeEntry(path string, entry *DirectoryEntry) error {
+	return s.encoder.Encode(manifestEntry{Record: recordEntry, Path: path, DirectoryEntry: entry})
+}
+
+func (s *ndjsonSink) writeTrailer(trailer manifestTrailer) error {
+	trailer.Record = recordTrailer
+	if err := s.encoder.Encode(trailer); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// treeSink reassembles streamed records into a DirectoryHashResult. Only the
+// children of directories that are not finished yet are held separately.
+type treeSink struct {
+	result  DirectoryHashResult
+	pending map[string][]*DirectoryEntry
+}
+
+func newTreeSink() *treeSink {
+	return &treeSink{pending: make(map[string][]*DirectoryEntry)}
+}
+
+func (s *treeSink) writeHeader(header manifestHeader) error {
+	s.result.RootPath = header.RootPath
+	s.result.Algorithm = header.Algorithm
+	s.result.Chunking = header.Chunking
+	s.result.Symlinks = header.Symlinks
+	s.result.SymlinksEscape = header.SymlinksEscape
+	s.result.IgnoreSources = header.IgnoreSources
+	s.result.Filters = header.Filters
+	return nil
+}
+
+func (s *treeSink) writeEntry(entryPath string, entry *DirectoryEntry) error {
+	if entry.Type == "directory" {
+		entry.Children = s.pending[entryPath]
+		delete(s.pending, entryPath)
+	}
+	if entryPath == "." {
+		s.result.DirectoryStructure = entry
+		return nil
+	}
+	parent := path.Dir(entryPath)
+	s.pending[parent] = append(s.pending[parent], entry)
+	return nil
+}
+
+func (s *treeSink) writeTrailer(trailer manifestTrailer) error {
+	if s.result.DirectoryStructure == nil {
+		return fmt.Errorf("manifest has no root directory entry")
+	}
+	s.result.RootDigest = trailer.RootDigest
+	s.result.TotalSize = trailer.TotalSize
+	s.result.TotalFiles = trailer.TotalFiles
+	s.result.HashingTime = trailer.HashingTime
+	s.result.Ignored = trailer.Ignored
+	s.result.IgnoredItems = trailer.IgnoredItems
+	return nil
+}
+
+// isManifestStream reports whether data starts with a streamed manifest
+// header rather than a single JSON document.
+func isManifestStream(data []byte) bool {
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	var probe struct {
+		Record string `json:"record"`
+	}
+	return json.Unmarshal(line, &probe) == nil && probe.Record == recordHeader
+}
+
+// readManifestStream decodes a streamed manifest from r into sink.
+func readManifestStream(r io.Reader, sink manifestSink) error {
+	decoder := json.NewDecoder(r)
+	sawTrailer := false
+	for line := 1; ; line++ {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("record %d: %w", line, err)
+		}
+		if sawTrailer {
+			return fmt.Errorf("record %d: data after trailer", line)
+		}
+
+		var probe struct {
+			Record string `json:"record"`
+		}
+		if err := json.Unmarshal(raw, &probe); err != nil {
+			return fmt.Errorf("record %d: %w", line, err)
+		}
+		if line == 1 && probe.Record != recordHeader {
+			return fmt.Errorf("record 1: expected header, got %q", probe.Record)
+		}
+
+		var err error
+		switch probe.Record {
+		case recordHeader:
+			var header manifestHeader
+			if err = json.Unmarshal(raw, &header); err == nil {
+				if header.Version > manifestVersion {
+					return fmt.Errorf("unsupported manifest version %d", header.Version)
+				}
+				err = sink.writeHeader(header)
+			}
+		case recordEntry:
+			entry := manifestEntry{DirectoryEntry: &DirectoryEntry{}}
+			if err = json.Unmarshal(raw, &entry); err == nil {
+				err = sink.writeEntry(entry.Path, entry.DirectoryEntry)
+			}
+		case recordTrailer:
+			var trailer manifestTrailer
+			if err = json.Unmarshal(raw, &trailer); err == nil {
+				err = sink.writeTrailer(trailer)
+			}
+			sawTrailer = true
+		default:
+			err = fmt.Errorf("unknown record type %q", probe.Record)
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", line, err)
+		}
+	}
+
+	if !sawTrailer {
+		return fmt.Errorf("manifest is truncated: no trailer")
+	}
+	return nil
+}
+
+// manifestSummary keeps only the header and trailer of a streamed manifest.
+type manifestSummary struct {
+	header  manifestHeader
+	trailer manifestTrailer
+}
+
+func (s *manifestSummary) writeHeader(header manifestHeader) error {
+	s.header = header
+	return nil
+}
+
+func (s *manifestSummary) writeEntry(string, *DirectoryEntry) error { return nil }
+
+func (s *manifestSummary) writeTrailer(trailer manifestTrailer) error {
+	s.trailer = trailer
+	return nil
+}
+
+// writeManifestTree streams an in-memory manifest to sink, in the same record
+// order hashing produces. A full list of ignored items is replaced by its
+// summary.
+func writeManifestTree(result *DirectoryHashResult, sink manifestSink) error {
+	err := sink.writeHeader(manifestHeader{
+		RootPath:       result.RootPath,
+		Algorithm:      result.Algorithm,
+		Chunking:       result.Chunking,
+		Symlinks:       result.Symlinks,
+		SymlinksEscape: result.SymlinksEscape,
+		IgnoreSources:  result.IgnoreSources,
+		Filters:        result.Filters,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeTreeEntries(".", result.DirectoryStructure, sink); err != nil {
+		return err
+	}
+	ignored := result.Ignored
+	if ignored == nil {
+		ignored = summarizeIgnoredItems(result.IgnoredItems)
+	}
+	return sink.writeTrailer(manifestTrailer{
+		RootDigest:  result.RootDigest,
+		TotalSize:   result.TotalSize,
+		TotalFiles:  result.TotalFiles,
+		HashingTime: result.HashingTime,
+		Ignored:     ignored,
+	})
+}
+
+func writeTreeEntries(entryPath string, entry *DirectoryEntry, sink manifestSink) error {
+	for _, child := range entry.Children {
+		if err := writeTreeEntries(path.Join(entryPath, child.Name), child, sink); err != nil {
+			return err
+		}
+	}
+	record := *entry
+	record.Children = nil
+	return sink.writeEntry(entryPath, &record)
+}
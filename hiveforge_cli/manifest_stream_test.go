@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// streamTestManifest hashes a small tree straight to NDJSON.
+func streamTestManifest(t *testing.T) []byte {
+	root := t.TempDir()
+	for _, name := range []string{"a.txt", "sub/b.txt", "sub/deeper/c.txt", "z/d.txt"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	_, err := hashDirectoryTo(context.Background(), root, HashOptions{
+		Chunking: testChunkingParams()["fixed"],
+		Hasher:   blake3Hasher{},
+		Jobs:     2,
+		NoCache:  true,
+		Symlinks: symlinksFollow,
+		Progress: progressNone,
+	}, newNDJSONSink(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestManifestStreamRoundTrip(t *testing.T) {
+	stream := streamTestManifest(t)
+
+	// Header, entries with every directory after its children, trailer
+	lines := strings.Split(strings.TrimSuffix(string(stream), "\n"), "\n")
+	written := make(map[string]bool)
+	for i, line := range lines {
+		var record struct {
+			Record string `json:"record"`
+			Path   string `json:"path"`
+			Type   string `json:"type"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case i == 0:
+			if record.Record != recordHeader {
+				t.Fatalf("record 1 is %q, want the header", record.Record)
+			}
+		case i == len(lines)-1:
+			if record.Record != recordTrailer {
+				t.Fatalf("last record is %q, want the trailer", record.Record)
+			}
+		case record.Record != recordEntry:
+			t.Fatalf("record %d is %q, want an entry", i+1, record.Record)
+		default:
+			for other := range written {
+				if record.Path != "." && strings.HasPrefix(record.Path, other+"/") {
+					t.Errorf("%s written after its directory %s", record.Path, other)
+				}
+			}
+			if record.Type == "directory" {
+				written[record.Path] = true
+			}
+		}
+	}
+	if root := lines[len(lines)-2]; !strings.Contains(root, `"path":"."`) {
+		t.Errorf("last entry is %s, want the root directory", root)
+	}
+
+	sink := newTreeSink()
+	if err := readManifestStream(bytes.NewReader(stream), sink); err != nil {
+		t.Fatal(err)
+	}
+	result := &sink.result
+	if result.TotalFiles != 4 || len(result.DirectoryStructure.Children) != 3 {
+		t.Fatalf("read back %d files and %d root children, want 4 and 3", result.TotalFiles, len(result.DirectoryStructure.Children))
+	}
+	if digest := directoryDigest(result.DirectoryStructure.Children, blake3Hasher{}); digest != result.RootDigest {
+		t.Errorf("rebuilt tree has digest %s, trailer says %s", digest, result.RootDigest)
+	}
+
+	// Writing the tree back out gives the same stream
+	var again bytes.Buffer
+	if err := writeManifestTree(result, newNDJSONSink(&again)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Bytes(), stream) {
+		t.Errorf("manifest changed in a round trip:\n%s\nwant:\n%s", again.Bytes(), stream)
+	}
+}
+
+func TestManifestStreamTruncated(t *testing.T) {
+	stream := streamTestManifest(t)
+	trailer := bytes.LastIndex(stream[:len(stream)-1], []byte("\n")) + 1
+
+	for name, cut := range map[string][]byte{
+		"before the trailer": stream[:trailer],
+		"inside the trailer": stream[:trailer+10],
+		"inside an entry":    stream[:trailer/2],
+		"after the header":   stream[:bytes.IndexByte(stream, '\n')+1],
+	} {
+		if err := readManifestStream(bytes.NewReader(cut), newTreeSink()); err == nil {
+			t.Errorf("manifest cut off %s was read without an error", name)
+		}
+	}
+}
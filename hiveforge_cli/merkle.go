@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// directoryDigest computes the Merkle digest of a directory from its direct
+// children, so two subtrees are identical exactly when their digests match.
+// Each child contributes "<type> <mode> <digest> <name>\x00" (mode in octal),
+// in name order; names cannot contain NUL, which keeps the encoding
+// unambiguous. Mtime and ownership are deliberately left out.
+func directoryDigest(children []*DirectoryEntry, hasher Hasher) string {
+	sorted := make([]*DirectoryEntry, len(children))
+	copy(sorted, children)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	h := hasher.New()
+	for _, child := range sorted {
+		writeMerkleEntry(h, child, hasher)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func writeMerkleEntry(w io.Writer, entry *DirectoryEntry, hasher Hasher) {
+	fmt.Fprintf(w, "%s %o %s %s\x00", entry.Type, entry.Mode, entryDigest(entry, hasher), entry.Name)
+}
+
+// entryDigest returns the content digest of any entry: the whole-file digest
+// for files, the Merkle digest for directories and the digest of the target
+// path for recorded symlinks.
+func entryDigest(entry *DirectoryEntry, hasher Hasher) string {
+	switch {
+	case entry.Hashes != nil:
+		return entry.Hashes.Digest
+	case entry.Type == "symlink":
+		return sumHex(hasher, []byte(entry.Target))
+	default:
+		return entry.Digest
+	}
+}
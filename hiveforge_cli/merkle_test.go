@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testTree builds root/{a.txt, sub/b.txt} with the Merkle digest of sub
+// filled in, so directoryDigest of the returned children is the root digest.
+func testTree() []*DirectoryEntry {
+	sub := &DirectoryEntry{Name: "sub", Type: "directory", Mode: 0755, Children: []*DirectoryEntry{
+		testFileEntry("b.txt", "b", 0644),
+	}}
+	return []*DirectoryEntry{testFileEntry("a.txt", "a", 0644), sub}
+}
+
+func testTreeDigest(children []*DirectoryEntry) string {
+	for _, child := range children {
+		if child.Type == "directory" {
+			child.Digest = testTreeDigest(child.Children)
+		}
+	}
+	return directoryDigest(children, blake3Hasher{})
+}
+
+func TestDirectoryDigestChanges(t *testing.T) {
+	base := testTreeDigest(testTree())
+
+	tests := []struct {
+		name   string
+		change func(root []*DirectoryEntry)
+		same   bool
+	}{
+		{"file name", func(root []*DirectoryEntry) { root[0].Name = "c.txt" }, false},
+		{"file mode", func(root []*DirectoryEntry) { root[0].Mode = 0600 }, false},
+		{"file content", func(root []*DirectoryEntry) { root[0].Hashes.Digest = "c" }, false},
+		{"nested name", func(root []*DirectoryEntry) { root[1].Children[0].Name = "c.txt" }, false},
+		{"nested mode", func(root []*DirectoryEntry) { root[1].Children[0].Mode = 0755 }, false},
+		{"nested content", func(root []*DirectoryEntry) { root[1].Children[0].Hashes.Digest = "c" }, false},
+		{"directory name", func(root []*DirectoryEntry) { root[1].Name = "lib" }, false},
+		{"directory mode", func(root []*DirectoryEntry) { root[1].Mode = 0700 }, false},
+		{"mtime", func(root []*DirectoryEntry) { root[0].ModTime = "2024-01-01T00:00:00Z" }, true},
+		{"child order", func(root []*DirectoryEntry) { root[0], root[1] = root[1], root[0] }, true},
+	}
+	for _, tt := range tests {
+		root := testTree()
+		tt.change(root)
+		if got := testTreeDigest(root); (got == base) != tt.same {
+			t.Errorf("%s: digest changed = %v, want %v", tt.name, got != base, !tt.same)
+		}
+	}
+}
+
+func TestRootDigestIndependentOfWalk(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"z.txt", "a.txt", "m/b.txt", "m/a.txt", "b/c/d.txt"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var want string
+	for _, jobs := range []int{1, 3, 16} {
+		result, err := hashDirectory(context.Background(), root, HashOptions{
+			Chunking: testChunkingParams()["fixed"],
+			Hasher:   blake3Hasher{},
+			Jobs:     jobs,
+			NoCache:  true,
+			Symlinks: symlinksFollow,
+			Progress: progressNone,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == "" {
+			want = result.RootDigest
+		} else if result.RootDigest != want {
+			t.Errorf("root digest with %d jobs = %s, want %s", jobs, result.RootDigest, want)
+		}
+
+		// Children listed in reverse, as another walk might find them
+		children := result.DirectoryStructure.Children
+		reversed := make([]*DirectoryEntry, len(children))
+		for i, child := range children {
+			reversed[len(children)-1-i] = child
+		}
+		if got := directoryDigest(reversed, blake3Hasher{}); got != want {
+			t.Errorf("root digest over reversed children = %s, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+	"golang.org/x/term"
+)
+
+// Progress modes for hashing. All progress goes to stderr, so stdout can
+// carry a manifest.
+const (
+	progressAuto  = "auto"  // bar on a terminal, plain otherwise
+	progressBar   = "bar"   // redrawn progress bar
+	progressPlain = "plain" // a line every few seconds, for CI logs
+	progressJSON  = "json"  // one JSON event per line, for wrapper tools
+	progressNone  = "none"  // --quiet: no progress and no summary
+
+	plainProgressInterval = 5 * time.Second
+	jsonProgressInterval  = time.Second
+	barRedrawInterval     = 100 * time.Millisecond
+	barRecentFiles        = 4 // files listed under the bar, the current one first
+)
+
+// addProgressFlags registers --progress and --quiet and returns a function
+// resolving them to a mode after parsing.
+func addProgressFlags(fs *flag.FlagSet) func() (string, error) {
+	mode := fs.String("progress", progressAuto, "Progress display: auto, bar, plain or json")
+	quiet := fs.Bool("quiet", false, "Show no progress and no summary")
+	return func() (string, error) {
+		if *quiet {
+			return progressNone, nil
+		}
+		switch *mode {
+		case progressAuto, progressBar, progressPlain, progressJSON:
+			return *mode, nil
+		default:
+			return "", fmt.Errorf("unknown progress mode %q (expected %s, %s, %s or %s)", *mode, progressAuto, progressBar, progressPlain, progressJSON)
+		}
+	}
+}
+
+// resolveProgressMode picks the bar or plain lines for "auto", depending on
+// whether stderr is a terminal.
+func resolveProgressMode(mode string) string {
+	if mode != progressAuto && mode != "" {
+		return mode
+	}
+	if term.IsTerminal(int(os.Stderr.Fd())) {
+		return progressBar
+	}
+	return progressPlain
+}
+
+// progressEvent is one line of --progress json. Totals grow while the walk
+// is still discovering files; WalkDone says they are final.
+type progressEvent struct {
+	Event       string  `json:"event"` // "start", "progress" or "done"
+	Files       int     `json:"files"`
+	TotalFiles  int     `json:"totalFiles"`
+	Bytes       int64   `json:"bytes"`
+	TotalBytes  int64   `json:"totalBytes"`
+	WalkDone    bool    `json:"walkDone"`
+	Elapsed     float64 `json:"elapsed"` // seconds
+	Current     string  `json:"current,omitempty"`
+	CacheHits   int     `json:"cacheHits,omitempty"`
+	CacheMisses int     `json:"cacheMisses,omitempty"`
+	Ignored     int     `json:"ignored,omitempty"`
+}
+
+// reportProgress redraws the bar or writes periodic progress lines until
+// stop is closed.
+func (ho *HashingOutput) reportProgress(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	interval := plainProgressInterval
+	switch ho.mode {
+	case progressJSON:
+		interval = jsonProgressInterval
+	case progressBar:
+		interval = barRedrawInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ho.mutex.Lock()
+			ho.writeProgress("progress")
+			ho.mutex.Unlock()
+		}
+	}
+}
+
+// writeProgress writes one progress line, or redraws the bar. The caller
+// holds the mutex.
+func (ho *HashingOutput) writeProgress(event string) {
+	switch ho.mode {
+	case progressBar:
+		ho.writeBarStatus()
+	case progressJSON:
+		record := progressEvent{
+			Event:      event,
+			Files:      ho.processedFiles,
+			TotalFiles: ho.totalFiles,
+			Bytes:      ho.processedSize,
+			TotalBytes: ho.totalSize,
+			WalkDone:   ho.walkDone,
+			Elapsed:    time.Since(ho.startTime).Seconds(),
+		}
+		if event == "done" {
+			record.CacheHits, record.CacheMisses = ho.cacheHits, ho.cacheMisses
+			record.Ignored = ho.ignored.total
+		} else {
+			record.Current = ho.currentFile
+		}
+		json.NewEncoder(ho.progressWriter).Encode(record)
+	case progressPlain:
+		writePlainProgress(ho.progressWriter, ho.processedFiles, ho.totalFiles, ho.processedSize, ho.totalSize,
+			ho.walkDone, time.Since(ho.startTime))
+	}
+}
+
+// writeBarStatus replaces the previous status with the bar, the totals, the
+// current file and the files started just before it.
+func (ho *HashingOutput) writeBarStatus() {
+	ho.clearBarStatus()
+	w := ho.progressWriter
+	more := "+"
+	if ho.walkDone {
+		more = ""
+	}
+	fmt.Fprintln(w, ho.bar.String())
+	fmt.Fprintf(w, "Files: %d/%d%s | Size: %.2f MB / %.2f%s MB | Time: %s\n",
+		ho.processedFiles, ho.totalFiles, more,
+		float64(ho.processedSize)/1024/1024, float64(ho.totalSize)/1024/1024, more,
+		time.Since(ho.startTime).Round(time.Second))
+	fmt.Fprintf(w, "Current file: %s\n", ho.currentFile)
+	fmt.Fprintln(w, "Recent files:")
+	for _, file := range ho.recentFiles {
+		fmt.Fprintf(w, "  %s\n", file)
+	}
+	ho.lastLines = 4 + len(ho.recentFiles)
+}
+
+// clearBarStatus moves the cursor back over the last status and erases it.
+func (ho *HashingOutput) clearBarStatus() {
+	if ho.lastLines > 0 {
+		fmt.Fprintf(ho.progressWriter, "\033[%dA\033[J", ho.lastLines)
+		ho.lastLines = 0
+	}
+}
+
+func writePlainProgress(w io.Writer, files, totalFiles int, size, totalSize int64, walkDone bool, elapsed time.Duration) {
+	// Until the walk is done the totals are only what was found so far
+	more := "+"
+	if walkDone {
+		more = ""
+	}
+	percent := 0.0
+	if totalSize > 0 {
+		percent = float64(size) / float64(totalSize) * 100
+	}
+	fmt.Fprintf(w, "Hashing: %d/%d%s files, %.2f/%.2f%s MB (%.0f%%), %s elapsed\n",
+		files, totalFiles, more, float64(size)/1024/1024, float64(totalSize)/1024/1024, more,
+		percent, elapsed.Round(time.Second))
+}
+
+// transferEvent is one line of --progress json while chunks are transferred.
+// Phase tells it apart from hashing events in the same stream.
+type transferEvent struct {
+	Event       string  `json:"event"` // "start", "progress" or "done"
+	Phase       string  `json:"phase"` // "upload"
+	Chunks      int     `json:"chunks"`
+	TotalChunks int     `json:"totalChunks"`
+	Bytes       int64   `json:"bytes"`
+	TotalBytes  int64   `json:"totalBytes"`
+	Elapsed     float64 `json:"elapsed"` // seconds
+}
+
+// transferProgress shows chunk transfers in the same modes as hashing. The
+// totals are known up front.
+type transferProgress struct {
+	mutex  sync.Mutex
+	mode   string // a resolved progress mode, never "auto"
+	phase  string
+	label  string // e.g. "Uploading"
+	bar    *progressbar.ProgressBar
+	writer io.Writer
+	stop   chan struct{}
+	done   chan struct{}
+
+	chunks, totalChunks int
+	bytes, totalBytes   int64
+	startTime           time.Time
+}
+
+// newTransferProgress starts showing progress right away; finish stops it.
+func newTransferProgress(mode, phase, label string, totalChunks int, totalBytes int64) *transferProgress {
+	p := &transferProgress{
+		mode:        resolveProgressMode(mode),
+		phase:       phase,
+		label:       label,
+		writer:      os.Stderr,
+		totalChunks: totalChunks,
+		totalBytes:  totalBytes,
+		startTime:   time.Now(),
+	}
+	switch p.mode {
+	case progressBar:
+		p.bar = progressbar.NewOptions64(
+			totalBytes,
+			progressbar.OptionSetWriter(os.Stderr),
+			progressbar.OptionSetWidth(50),
+			progressbar.OptionSetDescription(label),
+			progressbar.OptionSetRenderBlankState(true),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionThrottle(65*time.Millisecond),
+			progressbar.OptionOnCompletion(func() {}),
+		)
+	case progressPlain, progressJSON:
+		if p.mode == progressJSON {
+			p.write("start")
+		}
+		p.stop = make(chan struct{})
+		p.done = make(chan struct{})
+		go p.report()
+	}
+	return p
+}
+
+func (p *transferProgress) report() {
+	defer close(p.done)
+
+	interval := plainProgressInterval
+	if p.mode == progressJSON {
+		interval = jsonProgressInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.mutex.Lock()
+			p.write("progress")
+			p.mutex.Unlock()
+		}
+	}
+}
+
+// add records one transferred chunk.
+func (p *transferProgress) add(size int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.chunks++
+	p.bytes += size
+	if p.bar != nil {
+		p.bar.Add64(size)
+	}
+}
+
+// finish stops the progress output and writes its final line.
+func (p *transferProgress) finish() {
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+		p.stop = nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch p.mode {
+	case progressBar:
+		p.bar.Finish()
+		fmt.Fprintln(p.writer)
+	case progressPlain:
+		p.write("progress")
+	case progressJSON:
+		p.write("done")
+	}
+}
+
+// write writes one progress line. The caller holds the mutex, except before
+// the reporting goroutine is started.
+func (p *transferProgress) write(event string) {
+	elapsed := time.Since(p.startTime)
+	switch p.mode {
+	case progressJSON:
+		json.NewEncoder(p.writer).Encode(transferEvent{
+			Event:       event,
+			Phase:       p.phase,
+			Chunks:      p.chunks,
+			TotalChunks: p.totalChunks,
+			Bytes:       p.bytes,
+			TotalBytes:  p.totalBytes,
+			Elapsed:     elapsed.Seconds(),
+		})
+	case progressPlain:
+		percent := 0.0
+		if p.totalBytes > 0 {
+			percent = float64(p.bytes) / float64(p.totalBytes) * 100
+		}
+		fmt.Fprintf(p.writer, "%s: %d/%d chunks, %.2f/%.2f MB (%.0f%%), %s elapsed\n",
+			p.label, p.chunks, p.totalChunks, float64(p.bytes)/1024/1024, float64(p.totalBytes)/1024/1024,
+			percent, elapsed.Round(time.Second))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+// runTestProgress feeds two files through a HashingOutput writing progress to
+// a buffer.
+func runTestProgress(mode string) string {
+	var progress bytes.Buffer
+	ho := newHashingOutput(mode, nil, io.Discard)
+	ho.progressWriter = &progress
+	ho.start()
+	for _, file := range []string{"a.txt", "b.txt"} {
+		ho.addPending(1024 * 1024)
+		ho.updateCurrentFile(file)
+		ho.updateProgress(1024 * 1024)
+	}
+	ho.walkFinished()
+	ho.mutex.Lock()
+	ho.writeProgress("progress")
+	ho.mutex.Unlock()
+	ho.complete()
+	return progress.String()
+}
+
+func TestPlainProgress(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(runTestProgress(progressPlain), "\n"), "\n")
+	want := "Hashing: 2/2 files, 2.00/2.00 MB (100%), 0s elapsed"
+	if len(lines) != 2 || lines[0] != want || lines[1] != want {
+		t.Errorf("plain progress = %q, want two lines %q", lines, want)
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	var events []progressEvent
+	for _, line := range strings.Split(strings.TrimSuffix(runTestProgress(progressJSON), "\n"), "\n") {
+		var event progressEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("progress line %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want start, progress and done: %+v", len(events), events)
+	}
+	if start := events[0]; start.Event != "start" || start.Files != 0 || start.WalkDone {
+		t.Errorf("start event = %+v", start)
+	}
+	want := progressEvent{Event: "progress", Files: 2, TotalFiles: 2, Bytes: 2 << 20, TotalBytes: 2 << 20, WalkDone: true, Current: "b.txt"}
+	got := events[1]
+	got.Elapsed = 0
+	if got != want {
+		t.Errorf("progress event = %+v, want %+v", got, want)
+	}
+	if done := events[2]; done.Event != "done" || done.Files != 2 || done.Current != "" {
+		t.Errorf("done event = %+v, want the totals without a current file", done)
+	}
+}
+
+func TestBarProgressShowsRecentFiles(t *testing.T) {
+	output := runTestProgress(progressBar)
+	for _, want := range []string{"Current file: b.txt\n", "Recent files:\n  b.txt\n  a.txt\n", "Files: 2/2 | Size: 2.00 MB / 2.00 MB"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("bar output is missing %q:\n%s", want, output)
+		}
+	}
+	// The last status is erased, leaving only the finished bar
+	last := output[strings.LastIndex(output, "\033[J")+len("\033[J"):]
+	if !strings.Contains(last, "100%") || strings.Contains(last, "Current file") {
+		t.Errorf("bar output ends with %q, want only the finished bar", last)
+	}
+}
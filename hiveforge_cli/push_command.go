@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultUploadJobs = 4
+
+// PushOptions controls how chunk contents are uploaded.
+type PushOptions struct {
+	Jobs     int         // number of chunks uploaded concurrently
+	Progress string      // progress mode, see progress.go; "" is auto
+	Store    *chunkStore // chunks read from here rather than the files, if present
+	Output   io.Writer   // human-readable messages; os.Stdout if nil
+}
+
+// handlePush uploads the chunks of a stored snapshot the controller has no
+// content for yet, reading them from the directory the snapshot was hashed from.
+func handlePush(args []string, config Config, jwt *JWT) error {
+	fs := flag.NewFlagSet("push", flag.ContinueOnError)
+	jobs := fs.Int("jobs", defaultUploadJobs, "Number of chunks to upload in parallel")
+	progress := addProgressFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("usage: hiveforgectl push [--jobs N] [--progress auto|bar|plain|json] [--quiet] <snapshot-id> <directory>")
+	}
+	mode, err := progress()
+	if err != nil {
+		return err
+	}
+	if jwt == nil {
+		jwt = &JWT{}
+	}
+
+	id := strings.TrimPrefix(fs.Arg(0), snapshotPrefix)
+	manifest, err := fetchSnapshot(config, jwt, id)
+	if err != nil {
+		return err
+	}
+
+	store, err := openChunkStore(config)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	readManifest := func(sink manifestSink) error { return writeManifestTree(manifest, sink) }
+	return pushChunks(ctx, config, jwt, id, fs.Arg(1), readManifest, PushOptions{Jobs: *jobs, Progress: mode, Store: store})
+}
+
+// chunkLocation is where the bytes of a chunk can be read back from.
+type chunkLocation struct {
+	hash string
+	path string // relative to the root, slash-separated
+	chunkSpan
+}
+
+// chunkLocator is a manifestSink that finds the first occurrence of each
+// wanted chunk. Chunks are located in manifest order, so reads go through
+// each file front to back.
+type chunkLocator struct {
+	wanted    map[string]bool
+	locations []chunkLocation
+}
+
+func newChunkLocator(hashes []string) *chunkLocator {
+	wanted := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		wanted[hash] = true
+	}
+	return &chunkLocator{wanted: wanted}
+}
+
+func (l *chunkLocator) writeHeader(manifestHeader) error { return nil }
+
+func (l *chunkLocator) writeEntry(entryPath string, entry *DirectoryEntry) error {
+	if entry.Type != "file" || entry.Hashes == nil {
+		return nil
+	}
+	var spans []chunkSpan
+	for i, hash := range entry.Hashes.Hashes {
+		if !l.wanted[hash] {
+			continue
+		}
+		if spans == nil {
+			var err error
+			if spans, err = fileChunkSpans(entry.Hashes); err != nil {
+				return fmt.Errorf("%s: %w", entryPath, err)
+			}
+		}
+		delete(l.wanted, hash)
+		l.locations = append(l.locations, chunkLocation{hash: hash, path: entryPath, chunkSpan: spans[i]})
+	}
+	return nil
+}
+
+func (l *chunkLocator) writeTrailer(manifestTrailer) error { return nil }
+
+// pushChunks uploads the chunks of hash result id that the controller has no
+// content for, reading them from rootPath at the places the manifest lists.
+// readManifest streams the manifest of that hash result into a sink.
+func pushChunks(ctx context.Context, config Config, jwt *JWT, id string, rootPath string, readManifest func(manifestSink) error, opts PushOptions) error {
+	out := opts.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	missing, err := fetchMissingChunks(config, jwt, id)
+	if err != nil {
+		return err
+	}
+	if len(missing.Missing) == 0 {
+		fmt.Fprintf(out, "Nothing to push: the controller has every chunk of snapshot %s\n", id)
+		return nil
+	}
+	hasher, err := newHasher(missing.Algorithm)
+	if err != nil {
+		return err
+	}
+	client, err := newChunkClient(config, jwt, id)
+	if err != nil {
+		return err
+	}
+	client.acceptEncodings(missing.Encodings)
+
+	locator := newChunkLocator(missing.Missing)
+	if err := readManifest(locator); err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+	if len(locator.wanted) > 0 {
+		return fmt.Errorf("%d missing chunks do not appear in the manifest of snapshot %s", len(locator.wanted), id)
+	}
+
+	var totalSize int64
+	for _, location := range locator.locations {
+		totalSize += location.size
+	}
+	progress := newTransferProgress(opts.Progress, "upload", "Uploading", len(locator.locations), totalSize)
+	start := time.Now()
+
+	pusher := &chunkPusher{client: client, store: opts.Store, rootPath: rootPath, hasher: hasher}
+	err = forEachParallel(ctx, locator.locations, opts.Jobs, func(ctx context.Context, location chunkLocation) error {
+		if err := pusher.push(ctx, location); err != nil {
+			return err
+		}
+		progress.add(location.size)
+		return nil
+	})
+	progress.finish()
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("push interrupted: %w", err)
+	} else if err != nil {
+		return err
+	}
+
+	if progress.mode != progressJSON && progress.mode != progressNone {
+		fmt.Fprintf(out, "Pushed %d chunks (%.2f MB, %.2f MB sent) of snapshot %s in %s\n",
+			len(locator.locations), float64(totalSize)/1024/1024, float64(client.sent.Load())/1024/1024,
+			id, time.Since(start).Round(time.Second))
+	}
+	return nil
+}
+
+// chunkPusher reads chunks back from the local store or from disk and
+// uploads them.
+type chunkPusher struct {
+	client   *chunkClient
+	store    *chunkStore
+	rootPath string
+	hasher   Hasher
+}
+
+// push uploads one chunk. A chunk read from the file is checked to still
+// hold the bytes that were hashed.
+func (p *chunkPusher) push(ctx context.Context, location chunkLocation) error {
+	data, ok := p.storedChunk(location.hash)
+	if !ok {
+		var err error
+		data, err = readChunk(filepath.Join(p.rootPath, filepath.FromSlash(location.path)), location.chunkSpan)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", location.path, err)
+		}
+		if sumHex(p.hasher, data) != location.hash {
+			return fmt.Errorf("%s changed since it was hashed: the chunk at offset %d no longer matches %s; hash it again",
+				location.path, location.offset, location.hash)
+		}
+	}
+
+	if err := p.client.upload(ctx, location.hash, data); err != nil {
+		return fmt.Errorf("error uploading chunk %s of %s: %w", location.hash, location.path, err)
+	}
+	return nil
+}
+
+// storedChunk returns a chunk from the local store if it is there intact.
+func (p *chunkPusher) storedChunk(hash string) ([]byte, bool) {
+	if p.store == nil {
+		return nil, false
+	}
+	data, ok := p.store.get(p.hasher.Name(), hash)
+	if !ok {
+		return nil, false
+	}
+	if sumHex(p.hasher, data) != hash {
+		p.store.remove(p.hasher.Name(), hash)
+		return nil, false
+	}
+	return data, true
+}
+
+func readChunk(path string, span chunkSpan) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data := make([]byte, span.size)
+	if _, err := file.ReadAt(data, span.offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("file is shorter than when it was hashed")
+		}
+		return nil, err
+	}
+	return data, nil
+}
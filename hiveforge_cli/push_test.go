@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestFileChunkSpans(t *testing.T) {
+	data := testData(300*1024 + 17)
+	for scheme, params := range testChunkingParams() {
+		hashes, err := hashReader(bytes.NewReader(data), "data", int64(len(data)), params, blake3Hasher{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spans, err := fileChunkSpans(&hashes)
+		if err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		for i, span := range spans {
+			chunk := data[span.offset : span.offset+span.size]
+			if sumHex(blake3Hasher{}, chunk) != hashes.Hashes[i] {
+				t.Errorf("%s: chunk %d at %d+%d does not match its digest", scheme, i, span.offset, span.size)
+			}
+		}
+	}
+}
+
+// fakeChunkStore serves the missing-chunks and chunk endpoints of hash result 7.
+type fakeChunkStore struct {
+	mutex      sync.Mutex
+	missing    []string
+	stored     map[string][]byte
+	downloads  int
+	corrupt    bool // serve damaged chunks
+	compressed int  // zstd uploads and downloads
+}
+
+func (f *fakeChunkStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/api/v1/hash-results/7/missing-chunks":
+		json.NewEncoder(w).Encode(map[string]any{"id": 7, "algorithm": "blake3", "missing": f.missing, "encodings": []string{"zstd"}})
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/api/v1/hash-results/7/chunks/"):
+		hash := strings.TrimPrefix(r.URL.Path, "/api/v1/hash-results/7/chunks/")
+		data, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Encoding") == "zstd" {
+			f.compressed++
+			decoder, _ := zstd.NewReader(nil)
+			defer decoder.Close()
+			var err error
+			if data, err = decoder.DecodeAll(data, nil); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if sumHex(blake3Hasher{}, data) != hash {
+			http.Error(w, "digest mismatch", http.StatusUnprocessableEntity)
+			return
+		}
+		f.stored[hash] = data
+		w.Write([]byte(`{"status":"stored"}`))
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/v1/hash-results/7/chunks/"):
+		data, ok := f.stored[strings.TrimPrefix(r.URL.Path, "/api/v1/hash-results/7/chunks/")]
+		if !ok {
+			http.Error(w, "not pushed", http.StatusConflict)
+			return
+		}
+		f.downloads++
+		if f.corrupt {
+			data = append([]byte{'x'}, data[1:]...)
+		}
+		if r.Header.Get("Accept-Encoding") == "zstd" {
+			encoder, _ := zstd.NewWriter(nil)
+			if compressed := encoder.EncodeAll(data, nil); len(compressed) < len(data) {
+				f.compressed++
+				w.Header().Set("Content-Encoding", "zstd")
+				data = compressed
+			}
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestPushChunksUploadsMissing(t *testing.T) {
+	root := t.TempDir()
+	data := testData(200 * 1024)
+	if err := os.WriteFile(filepath.Join(root, "a.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Same content twice: each chunk is uploaded once
+	if err := os.WriteFile(filepath.Join(root, "b.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := hashForPush(t, root, nil)
+	store := fixture.controller
+	store.missing = fixture.chunks[:len(fixture.chunks)/2]
+	if err := fixture.push(PushOptions{Jobs: 3, Progress: progressNone}); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range store.missing {
+		if store.stored[hash] == nil {
+			t.Errorf("missing chunk %s was not uploaded", hash)
+		}
+	}
+	if len(store.stored) > len(store.missing) {
+		t.Errorf("uploaded %d chunks, only %d were missing", len(store.stored), len(store.missing))
+	}
+
+	// A file changed since hashing is caught before anything is sent
+	if err := os.WriteFile(filepath.Join(root, "a.bin"), testData(1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "b.bin"), testData(1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store.stored = make(map[string][]byte)
+	err := fixture.push(PushOptions{Jobs: 1, Progress: progressNone})
+	if err == nil || len(store.stored) != 0 {
+		t.Errorf("push of changed files = %v with %d chunks stored, want an error and none", err, len(store.stored))
+	}
+}
+
+// pushFixture is a hashed tree and a fake controller missing all its chunks.
+type pushFixture struct {
+	root       string
+	opts       HashOptions
+	manifest   *DirectoryHashResult
+	chunks     []string // every chunk digest, in manifest order
+	controller *fakeChunkStore
+	config     Config
+	jwt        *JWT
+}
+
+// hashForPush hashes root with FastCDC and BLAKE3, bypassing the cache, and
+// serves it as hash result 7. tweak, if not nil, adjusts the options first.
+func hashForPush(t *testing.T, root string, tweak func(*HashOptions)) *pushFixture {
+	f := &pushFixture{
+		root: root,
+		opts: HashOptions{
+			Chunking: testChunkingParams()["fastcdc"],
+			Hasher:   blake3Hasher{},
+			Jobs:     2,
+			NoCache:  true,
+			Symlinks: symlinksFollow,
+			Progress: progressNone,
+		},
+	}
+	if tweak != nil {
+		tweak(&f.opts)
+	}
+	manifest, err := hashDirectory(context.Background(), root, f.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.manifest = manifest
+	walkFiles(manifest.DirectoryStructure, func(h *FileHashes) { f.chunks = append(f.chunks, h.Hashes...) })
+	f.controller = &fakeChunkStore{missing: f.chunks, stored: make(map[string][]byte)}
+	f.config, f.jwt = startFakeController(t, f.controller)
+	return f
+}
+
+func (f *pushFixture) push(opts PushOptions) error {
+	readManifest := func(sink manifestSink) error { return writeManifestTree(f.manifest, sink) }
+	return pushChunks(context.Background(), f.config, f.jwt, "7", f.root, readManifest, opts)
+}
+
+// startFakeController serves handler for the duration of the test and returns
+// a config and token pointing at it.
+func startFakeController(t *testing.T, handler http.Handler) (Config, *JWT) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	config := Config{ApiEndpoint: host}
+	config.Port, _ = strconv.Atoi(port)
+	return config, &JWT{Token: "test", IssuedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultDownloadJobs = 4
+
+// RestoreOptions controls how a snapshot is written back to disk.
+type RestoreOptions struct {
+	Jobs     int         // number of files restored concurrently
+	Store    *chunkStore // local chunks to reuse and fill; nil to download every chunk
+	Force    bool        // restore into a destination that is not empty
+	Progress string      // progress mode, see progress.go; "" is auto
+}
+
+// handleRestore rebuilds the tree of a stored snapshot in a local directory.
+func handleRestore(args []string, config Config, jwt *JWT) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	jobs := fs.Int("jobs", defaultDownloadJobs, "Number of files to restore in parallel")
+	storePath := fs.String("store", "", "Local chunk store to reuse and fill (default: cas_dir from config, or ~/.hiveforge/cas)")
+	noStore := fs.Bool("no-store", false, "Download every chunk and keep no local copy")
+	force := fs.Bool("force", false, "Restore into a destination that is not empty, replacing files")
+	progress := addProgressFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("usage: hiveforgectl restore [--jobs N] [--store <dir>] [--no-store] [--force] [--progress auto|bar|plain|json] [--quiet] <snapshot-id> <destination>")
+	}
+	mode, err := progress()
+	if err != nil {
+		return err
+	}
+	if jwt == nil {
+		jwt = &JWT{}
+	}
+
+	opts := RestoreOptions{Jobs: *jobs, Force: *force, Progress: mode}
+	if !*noStore {
+		if opts.Store, err = openChunkStore(config); err != nil {
+			return err
+		}
+		if *storePath != "" {
+			opts.Store.dir = *storePath
+		}
+	}
+
+	id := strings.TrimPrefix(fs.Arg(0), snapshotPrefix)
+	manifest, err := fetchSnapshot(config, jwt, id)
+	if err != nil {
+		return err
+	}
+
+	client, err := newChunkClient(config, jwt, id)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := restoreSnapshot(ctx, manifest, client, fs.Arg(1), opts); err != nil {
+		return err
+	}
+	if opts.Store != nil {
+		if err := opts.Store.enforceLimit(os.Stdout); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// restoreItem is a manifest entry with its path relative to the root.
+type restoreItem struct {
+	path  string // slash-separated; "." for the root
+	entry *DirectoryEntry
+}
+
+// restorePlan lists what a snapshot consists of. Directories come children
+// first, so their modes can be applied bottom-up once everything is written.
+type restorePlan struct {
+	dirs   []restoreItem
+	files  []restoreItem
+	links  []restoreItem
+	chunks int
+	size   int64
+}
+
+func (p *restorePlan) add(entryPath string, entry *DirectoryEntry) error {
+	switch entry.Type {
+	case "directory":
+		for _, child := range entry.Children {
+			// Names come from the controller and must not climb out of the destination
+			if child.Name == "" || child.Name == "." || child.Name == ".." || strings.ContainsAny(child.Name, `/\`) {
+				return fmt.Errorf("manifest entry %q in %s has an invalid name", child.Name, entryPath)
+			}
+			if err := p.add(path.Join(entryPath, child.Name), child); err != nil {
+				return err
+			}
+		}
+		p.dirs = append(p.dirs, restoreItem{entryPath, entry})
+	case "file":
+		if entry.Hashes == nil {
+			return fmt.Errorf("%s: manifest has no chunk list", entryPath)
+		}
+		p.files = append(p.files, restoreItem{entryPath, entry})
+		p.chunks += len(entry.Hashes.Hashes)
+		p.size += entry.Hashes.TotalSize
+	case "symlink":
+		p.links = append(p.links, restoreItem{entryPath, entry})
+	default:
+		return fmt.Errorf("%s: unknown entry type %q", entryPath, entry.Type)
+	}
+	return nil
+}
+
+// restorer writes files back chunk by chunk, taking each chunk from the
+// local store if it is there and downloading it otherwise. Every chunk is
+// verified against its digest before it is written.
+type restorer struct {
+	client   *chunkClient
+	store    *chunkStore
+	hasher   Hasher
+	dest     string
+	progress *transferProgress
+
+	mutex    sync.Mutex
+	inflight map[string]*chunkDownload // shared by files needing the same chunk at once
+
+	storeHits       atomic.Int64
+	downloads       atomic.Int64
+	downloadedBytes atomic.Int64
+	storeWarning    sync.Once
+}
+
+type chunkDownload struct {
+	done chan struct{} // closed once data or err is set
+	data []byte
+	err  error
+}
+
+// restoreSnapshot rebuilds manifest under dest: directories, files with
+// their modes (and mtimes, if recorded) and symlinks.
+func restoreSnapshot(ctx context.Context, manifest *DirectoryHashResult, client *chunkClient, dest string, opts RestoreOptions) error {
+	hasher, err := newHasher(manifest.Algorithm)
+	if err != nil {
+		return err
+	}
+	var plan restorePlan
+	if err := plan.add(".", manifest.DirectoryStructure); err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+	if err := prepareRestoreDestination(dest, opts.Force); err != nil {
+		return err
+	}
+
+	for _, dir := range plan.dirs {
+		// Owner-writable until the files are in; the recorded mode comes last
+		if err := os.MkdirAll(filepath.Join(dest, filepath.FromSlash(dir.path)), 0700); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	r := &restorer{
+		client:   client,
+		store:    opts.Store,
+		hasher:   hasher,
+		dest:     dest,
+		inflight: make(map[string]*chunkDownload),
+		progress: newTransferProgress(opts.Progress, "restore", "Restoring", plan.chunks, plan.size),
+	}
+	err = forEachParallel(ctx, plan.files, opts.Jobs, r.restoreFile)
+	r.progress.finish()
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("restore interrupted, %s is incomplete: %w", dest, err)
+	} else if err != nil {
+		return err
+	}
+
+	for _, link := range plan.links {
+		target := filepath.Join(dest, filepath.FromSlash(link.path))
+		if err := removeForRestore(target); err != nil {
+			return err
+		}
+		if err := os.Symlink(link.entry.Target, target); err != nil {
+			return err
+		}
+	}
+	for _, dir := range plan.dirs {
+		if err := applyRestoredMetadata(filepath.Join(dest, filepath.FromSlash(dir.path)), dir.entry, 0755); err != nil {
+			return err
+		}
+	}
+
+	if r.progress.mode != progressJSON && r.progress.mode != progressNone {
+		fmt.Printf("Restored %d files (%.2f MB) to %s in %s: %d chunks from the local store, %d downloaded (%.2f MB, %.2f MB received)\n",
+			len(plan.files), float64(plan.size)/1024/1024, dest, time.Since(start).Round(time.Second),
+			r.storeHits.Load(), r.downloads.Load(), float64(r.downloadedBytes.Load())/1024/1024,
+			float64(client.received.Load())/1024/1024)
+	}
+	return nil
+}
+
+// prepareRestoreDestination creates dest, or checks it is empty unless force
+// is given.
+func prepareRestoreDestination(dest string, force bool) error {
+	entries, err := os.ReadDir(dest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.MkdirAll(dest, 0700)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 && !force {
+		return fmt.Errorf("destination %s is not empty; pass --force to restore into it", dest)
+	}
+	return nil
+}
+
+func (r *restorer) restoreFile(ctx context.Context, item restoreItem) error {
+	hashes := item.entry.Hashes
+	target := filepath.Join(r.dest, filepath.FromSlash(item.path))
+	if err := removeForRestore(target); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	digest := r.hasher.New()
+	for _, hash := range hashes.Hashes {
+		data, err := r.chunk(ctx, hash)
+		if err == nil {
+			_, err = file.Write(data)
+		}
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("%s: %w", item.path, err)
+		}
+		digest.Write(data)
+		r.progress.add(int64(len(data)))
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	// Chunks are verified one by one; this also catches a wrong chunk list
+	if got := fmt.Sprintf("%x", digest.Sum(nil)); got != hashes.Digest {
+		return fmt.Errorf("%s: restored content has digest %s, manifest says %s", item.path, got, hashes.Digest)
+	}
+	return applyRestoredMetadata(target, item.entry, 0644)
+}
+
+// chunk returns the verified bytes of a chunk.
+func (r *restorer) chunk(ctx context.Context, hash string) ([]byte, error) {
+	algorithm := r.hasher.Name()
+	if r.store != nil {
+		if data, ok := r.store.get(algorithm, hash); ok {
+			if sumHex(r.hasher, data) == hash {
+				r.storeHits.Add(1)
+				return data, nil
+			}
+			// A damaged copy is replaced by a downloaded one
+			r.store.remove(algorithm, hash)
+		}
+	}
+
+	r.mutex.Lock()
+	download, shared := r.inflight[hash]
+	if !shared {
+		download = &chunkDownload{done: make(chan struct{})}
+		r.inflight[hash] = download
+	}
+	r.mutex.Unlock()
+	if shared {
+		select {
+		case <-download.done:
+			return download.data, download.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	download.data, download.err = r.download(ctx, hash)
+	r.mutex.Lock()
+	delete(r.inflight, hash)
+	r.mutex.Unlock()
+	close(download.done)
+	return download.data, download.err
+}
+
+// download fetches a chunk from the controller, verifies it and keeps a copy
+// in the local store.
+func (r *restorer) download(ctx context.Context, hash string) ([]byte, error) {
+	algorithm := r.hasher.Name()
+	data, err := r.client.download(ctx, hash)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading chunk %s: %w", hash, err)
+	}
+	if sumHex(r.hasher, data) != hash {
+		return nil, fmt.Errorf("chunk %s failed verification: the downloaded bytes do not match its digest", hash)
+	}
+	r.downloads.Add(1)
+	r.downloadedBytes.Add(int64(len(data)))
+
+	if r.store != nil {
+		if err := r.store.put(algorithm, hash, data); err != nil {
+			r.storeWarning.Do(func() {
+				fmt.Fprintf(os.Stderr, "Warning: Could not keep downloaded chunks in %s: %v\n", r.store.dir, err)
+			})
+		}
+	}
+	return data, nil
+}
+
+// removeForRestore clears the way for an entry when restoring with --force.
+func removeForRestore(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// applyRestoredMetadata sets the recorded mode, or defaultMode for manifests
+// without one, and the recorded mtime.
+func applyRestoredMetadata(path string, entry *DirectoryEntry, defaultMode os.FileMode) error {
+	mode := defaultMode
+	if entry.Mode != 0 {
+		mode = fileModeFromPosix(entry.Mode)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if entry.ModTime != "" {
+		mtime, err := time.Parse(time.RFC3339Nano, entry.ModTime)
+		if err != nil {
+			return fmt.Errorf("%s: invalid mtime %q: %w", path, entry.ModTime, err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreSnapshot(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]struct {
+		data []byte
+		mode os.FileMode
+	}{
+		"bin/run.sh":     {[]byte("#!/bin/sh\necho hi\n"), 0755},
+		"data/large.bin": {testData(300 * 1024), 0644},
+		"data/copy.bin":  {testData(300 * 1024), 0600},
+		"empty":          {nil, 0644},
+	}
+	for name, file := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, file.data, file.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, file.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("bin/run.sh", filepath.Join(root, "run")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "bin"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(filepath.Join(root, "bin"), 0755) })
+
+	fixture := hashForPush(t, root, func(opts *HashOptions) { opts.Symlinks = symlinksRecord })
+	manifest, store := fixture.manifest, fixture.controller
+	if err := fixture.push(PushOptions{Jobs: 2, Progress: progressNone}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := newChunkClient(fixture.config, fixture.jwt, "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas := newChunkStore(t.TempDir())
+	restoreOpts := RestoreOptions{Jobs: 2, Store: cas, Progress: progressNone}
+	for i, dest := range []string{filepath.Join(t.TempDir(), "one"), filepath.Join(t.TempDir(), "two")} {
+		store.downloads = 0
+		if err := restoreSnapshot(context.Background(), manifest, client, dest, restoreOpts); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Chmod(filepath.Join(dest, "bin"), 0755) })
+
+		restored, err := hashDirectory(context.Background(), dest, fixture.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Modes and symlinks are part of the root digest
+		if restored.RootDigest != manifest.RootDigest {
+			t.Errorf("restore %d: root digest %s, want %s", i, restored.RootDigest, manifest.RootDigest)
+		}
+		if i == 0 && store.downloads != len(store.stored) {
+			t.Errorf("first restore downloaded %d chunks, want each of the %d once", store.downloads, len(store.stored))
+		}
+		if i == 1 && store.downloads != 0 {
+			t.Errorf("second restore downloaded %d chunks, want all from the local store", store.downloads)
+		}
+	}
+
+	// Damaged chunks are never written
+	store.corrupt = true
+	dest := filepath.Join(t.TempDir(), "bad")
+	err = restoreSnapshot(context.Background(), manifest, client, dest, RestoreOptions{Jobs: 1, Progress: progressNone})
+	if err == nil {
+		t.Fatal("restore of damaged chunks succeeded, want a verification error")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "data", "large.bin")); len(data) > 0 {
+		t.Errorf("wrote %d bytes of a damaged chunk", len(data))
+	}
+
+	// A destination that is not empty needs --force
+	if err := restoreSnapshot(context.Background(), manifest, client, root, restoreOpts); err == nil {
+		t.Error("restore into a non-empty directory succeeded without Force")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	symlinksSkip   = "skip"   // leave links out of the manifest
+	symlinksRecord = "record" // store the link target as a "symlink" entry
+	symlinksFollow = "follow" // hash whatever the link points to
+)
+
+func validateSymlinkPolicy(policy string) error {
+	switch policy {
+	case symlinksSkip, symlinksRecord, symlinksFollow:
+		return nil
+	default:
+		return fmt.Errorf("unknown symlink policy %q (expected %s, %s or %s)", policy, symlinksSkip, symlinksRecord, symlinksFollow)
+	}
+}
+
+// symlinkGuard keeps the "follow" policy safe: it refuses targets outside the
+// root unless allowed, and detects cycles by remembering the real paths of the
+// directories currently being walked.
+type symlinkGuard struct {
+	policy      string
+	allowEscape bool
+	realRoot    string
+	ancestors   map[string]bool
+}
+
+func newSymlinkGuard(rootPath string, opts HashOptions) (*symlinkGuard, error) {
+	realRoot, err := filepath.EvalSymlinks(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	realRoot, err = filepath.Abs(realRoot)
+	if err != nil {
+		return nil, err
+	}
+	return &symlinkGuard{
+		policy:      opts.Symlinks,
+		allowEscape: opts.SymlinksEscape,
+		realRoot:    realRoot,
+		ancestors:   make(map[string]bool),
+	}, nil
+}
+
+// resolve follows the link at path and returns the target's real path and info.
+func (g *symlinkGuard) resolve(path string) (string, os.FileInfo, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("broken symlink: %w", err)
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return "", nil, err
+	}
+	if !g.allowEscape && !g.insideRoot(target) {
+		return "", nil, fmt.Errorf("symlink target %s is outside the root", target)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return "", nil, err
+	}
+	if info.IsDir() && g.ancestors[target] {
+		return "", nil, fmt.Errorf("symlink cycle back to %s", target)
+	}
+	return target, info, nil
+}
+
+func (g *symlinkGuard) insideRoot(path string) bool {
+	return path == g.realRoot || strings.HasPrefix(path, g.realRoot+string(filepath.Separator))
+}
+
+func (g *symlinkGuard) enter(realDir string) { g.ancestors[realDir] = true }
+func (g *symlinkGuard) leave(realDir string) { delete(g.ancestors, realDir) }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// manifestPaths lists the files and symlinks of a manifest as "path" and
+// "path -> target", and the ignored paths below root by kind.
+func manifestPaths(result *DirectoryHashResult, root string) ([]string, map[string][]string) {
+	var entries []string
+	var walk func(dir string, entry *DirectoryEntry)
+	walk = func(dir string, entry *DirectoryEntry) {
+		for _, child := range entry.Children {
+			childPath := path.Join(dir, child.Name)
+			switch child.Type {
+			case "file":
+				entries = append(entries, childPath)
+			case "symlink":
+				entries = append(entries, childPath+" -> "+child.Target)
+			case "directory":
+				walk(childPath, child)
+			}
+		}
+	}
+	walk("", result.DirectoryStructure)
+	sort.Strings(entries)
+
+	ignored := make(map[string][]string)
+	if result.Ignored != nil {
+		for _, group := range result.Ignored.Groups {
+			for _, sample := range group.Samples {
+				// Samples read "<path> (<reason>)"
+				sample, _, _ = strings.Cut(sample, " (")
+				rel, _ := filepath.Rel(root, sample)
+				ignored[group.Kind] = append(ignored[group.Kind], filepath.ToSlash(rel))
+			}
+		}
+	}
+	for _, paths := range ignored {
+		sort.Strings(paths)
+	}
+	return entries, ignored
+}
+
+func TestSymlinkPolicies(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	for name, content := range map[string]string{
+		"root/a.txt":         "a",
+		"root/sub/b.txt":     "b",
+		"outside/secret.txt": "secret",
+	} {
+		path := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"root/link.txt": "a.txt",      // a file inside the root
+		"root/sub/up":   "..",         // the parent directory: a cycle when followed
+		"root/out":      "../outside", // a directory outside the root
+	} {
+		if err := os.Symlink(target, filepath.Join(base, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		policy  string
+		escape  bool
+		entries []string
+		ignored map[string][]string
+	}{
+		{
+			policy:  symlinksFollow,
+			entries: []string{"a.txt", "link.txt", "sub/b.txt"},
+			ignored: map[string][]string{"symlink": {"out", "sub/up"}},
+		},
+		{
+			policy:  symlinksFollow,
+			escape:  true,
+			entries: []string{"a.txt", "link.txt", "out/secret.txt", "sub/b.txt"},
+			ignored: map[string][]string{"symlink": {"sub/up"}},
+		},
+		{
+			policy:  symlinksRecord,
+			entries: []string{"a.txt", "link.txt -> a.txt", "out -> ../outside", "sub/b.txt", "sub/up -> .."},
+			ignored: map[string][]string{},
+		},
+		{
+			policy:  symlinksSkip,
+			entries: []string{"a.txt", "sub/b.txt"},
+			ignored: map[string][]string{"symlink": {"link.txt", "out", "sub/up"}},
+		},
+	}
+	for _, tt := range tests {
+		result, err := hashDirectory(context.Background(), root, HashOptions{
+			Chunking:       testChunkingParams()["fixed"],
+			Hasher:         blake3Hasher{},
+			Jobs:           2,
+			NoCache:        true,
+			Symlinks:       tt.policy,
+			SymlinksEscape: tt.escape,
+			Progress:       progressNone,
+		})
+		if err != nil {
+			t.Fatalf("%s (escape %v): %v", tt.policy, tt.escape, err)
+		}
+		entries, ignored := manifestPaths(result, root)
+		if !reflect.DeepEqual(entries, tt.entries) {
+			t.Errorf("%s (escape %v): entries = %q, want %q", tt.policy, tt.escape, entries, tt.entries)
+		}
+		if !reflect.DeepEqual(ignored, tt.ignored) {
+			t.Errorf("%s (escape %v): ignored = %q, want %q", tt.policy, tt.escape, ignored, tt.ignored)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"path"
+	"reflect"
+	"sort"
+)
+
+const (
+	changeAdded    = "added"
+	changeRemoved  = "removed"
+	changeModified = "modified"
+	changeMode     = "mode"
+)
+
+// FileChange is one difference between two manifests. Paths are relative to
+// the root and use forward slashes.
+type FileChange struct {
+	Path string          `json:"path"`
+	Kind string          `json:"kind"` // added, removed, modified or mode
+	Old  *DirectoryEntry `json:"-"`
+	New  *DirectoryEntry `json:"-"`
+}
+
+// diffTrees lists the differences between two directory trees. Subtrees with
+// equal Merkle digests are skipped without being walked. Added and removed
+// directories are expanded to their files, so every change names a file,
+// a symlink or an empty directory.
+func diffTrees(oldRoot, newRoot *DirectoryEntry) []FileChange {
+	var changes []FileChange
+	diffChildren("", oldRoot, newRoot, &changes)
+	return changes
+}
+
+func diffChildren(prefix string, oldDir, newDir *DirectoryEntry, changes *[]FileChange) {
+	if oldDir.Digest != "" && oldDir.Digest == newDir.Digest {
+		return
+	}
+
+	oldChildren := childrenByName(oldDir)
+	newChildren := childrenByName(newDir)
+
+	names := make([]string, 0, len(oldChildren)+len(newChildren))
+	for name := range oldChildren {
+		names = append(names, name)
+	}
+	for name := range newChildren {
+		if _, ok := oldChildren[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		childPath := path.Join(prefix, name)
+		oldChild, newChild := oldChildren[name], newChildren[name]
+
+		switch {
+		case newChild == nil:
+			collectLeaves(childPath, oldChild, changeRemoved, changes)
+		case oldChild == nil:
+			collectLeaves(childPath, newChild, changeAdded, changes)
+		case oldChild.Type != newChild.Type:
+			collectLeaves(childPath, oldChild, changeRemoved, changes)
+			collectLeaves(childPath, newChild, changeAdded, changes)
+		case oldChild.Type == "directory":
+			if oldChild.Mode != newChild.Mode {
+				*changes = append(*changes, FileChange{Path: childPath, Kind: changeMode, Old: oldChild, New: newChild})
+			}
+			diffChildren(childPath, oldChild, newChild, changes)
+		default:
+			// A file can change both ways at once, and is then reported twice
+			if !sameContent(oldChild, newChild) {
+				*changes = append(*changes, FileChange{Path: childPath, Kind: changeModified, Old: oldChild, New: newChild})
+			}
+			if oldChild.Mode != newChild.Mode {
+				*changes = append(*changes, FileChange{Path: childPath, Kind: changeMode, Old: oldChild, New: newChild})
+			}
+		}
+	}
+}
+
+func childrenByName(dir *DirectoryEntry) map[string]*DirectoryEntry {
+	children := make(map[string]*DirectoryEntry, len(dir.Children))
+	for _, child := range dir.Children {
+		children[child.Name] = child
+	}
+	return children
+}
+
+// collectLeaves reports entry, or everything below it if it is a non-empty
+// directory, as a single kind of change.
+func collectLeaves(entryPath string, entry *DirectoryEntry, kind string, changes *[]FileChange) {
+	if entry.Type == "directory" && len(entry.Children) > 0 {
+		for _, child := range entry.Children {
+			collectLeaves(path.Join(entryPath, child.Name), child, kind, changes)
+		}
+		return
+	}
+
+	change := FileChange{Path: entryPath, Kind: kind}
+	if kind == changeRemoved {
+		change.Old = entry
+	} else {
+		change.New = entry
+	}
+	*changes = append(*changes, change)
+}
+
+// sameContent compares two files or symlinks. Manifests written before
+// whole-file digests existed fall back to comparing chunk hashes.
+func sameContent(a, b *DirectoryEntry) bool {
+	if a.Type == "symlink" {
+		return a.Target == b.Target
+	}
+	if a.Hashes == nil || b.Hashes == nil {
+		return a.Hashes == b.Hashes && a.Size == b.Size
+	}
+	if a.Hashes.Algorithm != b.Hashes.Algorithm {
+		return false
+	}
+	if a.Hashes.Digest != "" && b.Hashes.Digest != "" {
+		return a.Hashes.Digest == b.Hashes.Digest
+	}
+	return a.Size == b.Size && reflect.DeepEqual(a.Hashes.Hashes, b.Hashes.Hashes)
+}
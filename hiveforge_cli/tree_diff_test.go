@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testFileEntry(name, digest string, mode uint32) *DirectoryEntry {
+	return &DirectoryEntry{Name: name, Type: "file", Size: 1, Mode: mode, Hashes: &FileHashes{Algorithm: "blake3", Digest: digest}}
+}
+
+func TestDiffTrees(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new *DirectoryEntry
+		want     []string
+	}{
+		{"unchanged", testFileEntry("a", "1", 0644), testFileEntry("a", "1", 0644), nil},
+		{"content", testFileEntry("a", "1", 0644), testFileEntry("a", "2", 0644), []string{"modified a"}},
+		{"mode", testFileEntry("a", "1", 0644), testFileEntry("a", "1", 0755), []string{"mode a"}},
+		{"content and mode", testFileEntry("a", "1", 0644), testFileEntry("a", "2", 0755), []string{"modified a", "mode a"}},
+		{"type", testFileEntry("a", "1", 0644), &DirectoryEntry{Name: "a", Type: "symlink", Target: "b"}, []string{"removed a", "added a"}},
+		{
+			"directory mode",
+			&DirectoryEntry{Name: "a", Type: "directory", Mode: 0755, Children: []*DirectoryEntry{testFileEntry("b", "1", 0644)}},
+			&DirectoryEntry{Name: "a", Type: "directory", Mode: 0700, Children: []*DirectoryEntry{testFileEntry("b", "2", 0644)}},
+			[]string{"mode a", "modified a/b"},
+		},
+	}
+	for _, tt := range tests {
+		oldRoot := &DirectoryEntry{Type: "directory", Children: []*DirectoryEntry{tt.old}}
+		newRoot := &DirectoryEntry{Type: "directory", Children: []*DirectoryEntry{tt.new}}
+		var got []string
+		for _, change := range diffTrees(oldRoot, newRoot) {
+			got = append(got, change.Kind+" "+change.Path)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: changes = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,25 +2,90 @@ package main
 
 type DirectoryHashResult struct {
 	RootPath           string          `json:"root"`
+	RootDigest         string          `json:"rootDigest"`
+	Algorithm          string          `json:"algorithm"` // digest algorithm for every hash below
+	Chunking           ChunkingParams  `json:"chunking"`
+	Symlinks           string          `json:"symlinks,omitempty"` // symlink policy used for the walk
+	SymlinksEscape     bool            `json:"symlinksEscape,omitempty"`
+	IgnoreSources      []string        `json:"ignoreSources,omitempty"` // ignore files read besides .hiveignore
+	Filters            *HashFilters    `json:"filters,omitempty"`
 	DirectoryStructure *DirectoryEntry `json:"dir"`
 	TotalSize          int64           `json:"size"`
 	TotalFiles         int             `json:"files"`
 	HashingTime        float64         `json:"time"`
-	IgnoredItems       []IgnoredItem   `json:"ignoredItems"`
+	Ignored            *IgnoredSummary `json:"ignored,omitempty"`
+	IgnoredItems       []IgnoredItem   `json:"ignoredItems,omitempty"` // every item, as written by older versions
 }
 
 type DirectoryEntry struct {
 	Name     string            `json:"name"`
-	Type     string            `json:"type"` // "file" for file, "dir" for directory
+	Type     string            `json:"type"` // "file", "directory" or "symlink"
 	Size     int64             `json:"size"`
+	Digest   string            `json:"digest,omitempty"` // Merkle digest, directories only
+	Target   string            `json:"target,omitempty"` // link target, symlinks only
+	Mode     uint32            `json:"mode,omitempty"`   // POSIX permission bits, e.g. 0755
+	ModTime  string            `json:"mtime,omitempty"`  // RFC 3339, only with --mtime
+	UID      *int              `json:"uid,omitempty"`    // only with --owner
+	GID      *int              `json:"gid,omitempty"`    // only with --owner
 	Children []*DirectoryEntry `json:"children,omitempty"`
 	Hashes   *FileHashes       `json:"hashes,omitempty"`
 }
 
 type FileHashes struct {
-	FileName   string   `json:"name"`
-	ChunkSize  int      `json:"chunkSize,omitempty"`
-	ChunkCount int      `json:"chunkCount,omitempty"`
-	Hashes     []string `json:"hashes"`
-	TotalSize  int64    `json:"size"`
+	FileName     string   `json:"name"`
+	Algorithm    string   `json:"algorithm"`
+	Chunking     string   `json:"chunking,omitempty"`
+	ChunkSize    int      `json:"chunkSize,omitempty"`
+	MinChunkSize int      `json:"minChunkSize,omitempty"`
+	AvgChunkSize int      `json:"avgChunkSize,omitempty"`
+	MaxChunkSize int      `json:"maxChunkSize,omitempty"`
+	ChunkCount   int      `json:"chunkCount,omitempty"`
+	ChunkSizes   []int    `json:"chunkSizes,omitempty"` // only for content-defined chunking
+	Hashes       []string `json:"hashes"`
+	Digest       string   `json:"digest"` // digest of the whole file
+	TotalSize    int64    `json:"size"`
+}
+
+// ChunkingParams describes how file contents were split into chunks.
+// Sizes are only meaningful for content-defined chunking.
+type ChunkingParams struct {
+	Scheme  string `json:"scheme"` // "fixed" or "fastcdc"
+	MinSize int    `json:"minSize,omitempty"`
+	AvgSize int    `json:"avgSize,omitempty"`
+	MaxSize int    `json:"maxSize,omitempty"`
+}
+
+// HashFilters narrow down what is hashed beyond the ignore files.
+type HashFilters struct {
+	MaxSize     int64    `json:"maxSize,omitempty"`     // regular files above this many bytes are skipped; 0 for no limit
+	Include     []string `json:"include,omitempty"`     // root-relative globs; if set, only matching paths are hashed
+	SkipSpecial bool     `json:"skipSpecial,omitempty"` // leave out devices, sockets and pipes without a warning
+}
+
+// IgnoredItem is a path left out of the manifest. Kind says why in a form
+// tools can filter on; Reason explains it to people.
+type IgnoredItem struct {
+	Path    string `json:"path"`
+	Reason  string `json:"reason"`
+	Kind    string `json:"kind,omitempty"`
+	Pattern string `json:"pattern,omitempty"` // the ignore pattern or include glob that decided
+	Source  string `json:"source,omitempty"`  // where the pattern came from, e.g. ".hiveignore:3"
+	Size    int64  `json:"size,omitempty"`    // only for files skipped by size
+}
+
+// IgnoredSummary is the bounded account of ignored items a manifest carries:
+// one group per rule with a count and a few sample paths.
+type IgnoredSummary struct {
+	Total         int            `json:"total"`
+	Groups        []IgnoredGroup `json:"groups"`
+	OmittedGroups int            `json:"omittedGroups,omitempty"` // smallest groups left out
+}
+
+type IgnoredGroup struct {
+	Kind    string   `json:"kind"`
+	Pattern string   `json:"pattern,omitempty"`
+	Source  string   `json:"source,omitempty"`
+	Reason  string   `json:"reason"`
+	Count   int      `json:"count"`
+	Samples []string `json:"samples"`
 }
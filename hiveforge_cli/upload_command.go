@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// handleUpload sends a manifest written by hash --output to the controller.
+// Older single-document manifests are converted to the streamed format.
+func handleUpload(args []string, config Config, jwt *JWT) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: hiveforgectl upload <manifest>")
+	}
+	manifestPath := args[0]
+	if jwt == nil {
+		jwt = &JWT{}
+	}
+
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	spool, err := os.CreateTemp("", "hiveforge-manifest-*.ndjson.gz")
+	if err != nil {
+		return fmt.Errorf("error creating manifest spool file: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	gzWriter := gzip.NewWriter(spool)
+
+	// A streamed manifest is validated and compressed in one pass
+	reader := bufio.NewReaderSize(file, 64*1024)
+	head, _ := reader.Peek(64 * 1024)
+	var summary manifestSummary
+	if isManifestStream(head) {
+		if err := readManifestStream(io.TeeReader(reader, gzWriter), &summary); err != nil {
+			return fmt.Errorf("invalid manifest %s: %w", manifestPath, err)
+		}
+	} else {
+		result, err := readManifest(manifestPath)
+		if err != nil {
+			return err
+		}
+		sink := newNDJSONSink(gzWriter)
+		if err := writeManifestTree(result, sink); err != nil {
+			return fmt.Errorf("error converting manifest: %w", err)
+		}
+		summary.header.RootPath = result.RootPath
+		summary.trailer.TotalFiles = result.TotalFiles
+		summary.trailer.TotalSize = result.TotalSize
+		summary.trailer.HashingTime = result.HashingTime
+	}
+	if err := gzWriter.Close(); err != nil {
+		return fmt.Errorf("error compressing manifest: %w", err)
+	}
+
+	if _, err := sendManifestToAPI(os.Stdout, config, jwt, summary.header.RootPath, summary.trailer, spool); err != nil {
+		return fmt.Errorf("error sending hash result to API: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// handleVerify re-hashes a directory and compares it with a manifest. Every
+// file is read: the hash cache trusts size, mtime and inode, which a file
+// changed in place can keep.
+func handleVerify(args []string, config Config) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	jobs := fs.Int("jobs", runtime.NumCPU(), "Number of files to hash in parallel")
+	progress := addProgressFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	progressMode, err := progress()
+	if err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("usage: hiveforgectl verify [--jobs N] [--progress auto|bar|plain|json] [--quiet] <directory> <manifest.json>")
+	}
+	directory, manifestPath := fs.Arg(0), fs.Arg(1)
+
+	expected, err := readManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	opts, err := manifestHashOptions(expected)
+	if err != nil {
+		return err
+	}
+	opts.Jobs = *jobs
+	opts.NoCache = true
+	opts.Progress = progressMode
+	// The manifest may be kept inside the directory it describes
+	if info, err := os.Stat(manifestPath); err == nil {
+		opts.SkipFiles = append(opts.SkipFiles, info)
+	}
+
+	actual, err := hashDirectory(context.Background(), directory, opts)
+	if err != nil {
+		return fmt.Errorf("error hashing directory: %w", err)
+	}
+
+	if expected.RootDigest != "" && expected.RootDigest == actual.RootDigest {
+		fmt.Printf("OK: %s matches %s (root digest %s)\n", directory, manifestPath, actual.RootDigest)
+		return nil
+	}
+
+	changes := diffTrees(expected.DirectoryStructure, actual.DirectoryStructure)
+	if len(changes) == 0 {
+		fmt.Printf("OK: %s matches %s\n", directory, manifestPath)
+		return nil
+	}
+
+	printChanges(changes)
+	return fmt.Errorf("%s does not match %s: %d differences", directory, manifestPath, len(changes))
+}
+
+// manifestHashOptions rebuilds the options a manifest was produced with, so a
+// re-hash yields comparable digests and chunk lists.
+func manifestHashOptions(manifest *DirectoryHashResult) (HashOptions, error) {
+	hasher, err := newHasher(manifest.Algorithm)
+	if err != nil {
+		return HashOptions{}, err
+	}
+
+	if err := manifest.Chunking.validate(); err != nil {
+		return HashOptions{}, err
+	}
+	if err := validateSymlinkPolicy(manifest.Symlinks); err != nil {
+		return HashOptions{}, err
+	}
+	ignore, err := ignoreOptionsFromSources(manifest.IgnoreSources)
+	if err != nil {
+		return HashOptions{}, err
+	}
+
+	var filters HashFilters
+	if manifest.Filters != nil {
+		filters = *manifest.Filters
+	}
+
+	return HashOptions{
+		Chunking:       manifest.Chunking,
+		Hasher:         hasher,
+		Symlinks:       manifest.Symlinks,
+		SymlinksEscape: manifest.SymlinksEscape,
+		Ignore:         ignore,
+		Filters:        filters,
+	}, nil
+}
+
+func printChanges(changes []FileChange) {
+	for _, change := range changes {
+		switch change.Kind {
+		case changeAdded:
+			fmt.Printf("  added:        %s\n", change.Path)
+		case changeRemoved:
+			fmt.Printf("  removed:      %s\n", change.Path)
+		case changeModified:
+			fmt.Printf("  modified:     %s\n", change.Path)
+		case changeMode:
+			fmt.Printf("  mode changed: %s (%04o -> %04o)\n", change.Path, change.Old.Mode, change.New.Mode)
+		}
+	}
+}
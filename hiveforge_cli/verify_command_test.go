@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cliArgsEnv makes the test binary run hiveforgectl's main with these
+// newline-separated arguments instead of the tests.
+const cliArgsEnv = "HIVEFORGE_TEST_CLI_ARGS"
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(cliArgsEnv); ok {
+		os.Args = append([]string{"hiveforgectl"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCLI runs hiveforgectl in a child process and returns its stdout, stderr
+// and exit status.
+func runCLI(t *testing.T, args ...string) (string, string, int) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), cliArgsEnv+"="+strings.Join(args, "\n"))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stdout.String(), stderr.String(), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+func TestVerifyDetectsChangeKeepingSizeAndMtime(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	file := filepath.Join(root, "a.txt")
+	if err := os.WriteFile(file, []byte("original content\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Old enough to be cached
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hashing with the cache records the file in ~/.hiveforge/hash_cache.json
+	manifest, err := hashDirectory(context.Background(), root, HashOptions{
+		Chunking: testChunkingParams()["fixed"],
+		Hasher:   blake3Hasher{},
+		Jobs:     1,
+		Symlinks: symlinksFollow,
+		Progress: progressNone,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(t.TempDir(), "m.json")
+	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, _, status := runCLI(t, "verify", "--quiet", root, manifestPath)
+	if status != 0 {
+		t.Fatalf("verify of an unchanged tree exited with %d:\n%s", status, stdout)
+	}
+
+	// Same size, same inode, mtime put back
+	if err := os.WriteFile(file, []byte("tampered content\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	stdout, _, status = runCLI(t, "verify", "--quiet", root, manifestPath)
+	if status != 1 || !strings.Contains(stdout, "modified:     a.txt") {
+		t.Errorf("verify of a file changed in place exited with %d, want 1 and a.txt modified:\n%s", status, stdout)
+	}
+}
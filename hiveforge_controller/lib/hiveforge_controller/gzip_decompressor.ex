@@ -12,7 +12,7 @@ defmodule HiveforgeController.GzipDecompressor do
   end
 
   defp decompress_body(conn) do
-    {:ok, body, conn} = read_body(conn)
+    {:ok, body, conn} = read_full_body(conn)
     Logger.info("GzipDecompressor: Read body, size: #{byte_size(body)} bytes")
 
     case :zlib.gunzip(body) do
@@ -33,4 +33,13 @@ defmodule HiveforgeController.GzipDecompressor do
       Logger.error("GzipDecompressor: Error during decompression: #{inspect(e)}")
       conn
   end
+
+  # read_body/1 hands out at most 8 MB per call; streamed manifests are larger
+  defp read_full_body(conn, acc \\ []) do
+    case read_body(conn) do
+      {:ok, body, conn} -> {:ok, IO.iodata_to_binary([acc, body]), conn}
+      {:more, body, conn} -> read_full_body(conn, [acc, body])
+      {:error, reason} -> {:error, reason}
+    end
+  end
 end
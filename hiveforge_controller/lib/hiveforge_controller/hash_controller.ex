@@ -1,9 +1,14 @@
 defmodule HiveforgeController.HashController do
   import Plug.Conn
   require Logger
-  alias HiveforgeController.{ApiKeyService, HashService}
+  alias HiveforgeController.{ApiKeyService, HashService, Zstd}
 
   @max_log_length 200
+  # Well above the largest chunk the CLI produces
+  @max_chunk_length 64_000_000
+  # Content encodings accepted for chunk uploads, offered in missing-chunks
+  @chunk_encodings ["zstd"]
+  @zstd_level 3
 
   @spec init(any) :: any
   def init(opts), do: opts
@@ -13,6 +18,210 @@ defmodule HiveforgeController.HashController do
     receive_hash(conn)
   end
 
+  def call(conn, action: :get_manifest) do
+    get_manifest(conn)
+  end
+
+  def call(conn, action: :missing_chunks) do
+    missing_chunks(conn)
+  end
+
+  def call(conn, action: :upload_chunk) do
+    upload_chunk(conn)
+  end
+
+  def call(conn, action: :download_chunk) do
+    download_chunk(conn)
+  end
+
+  defp get_manifest(conn) do
+    claims = conn.assigns[:current_user]
+    id = conn.path_params["id"]
+
+    with :ok <- ApiKeyService.authorize_action(claims, :get_hash_result),
+         {:ok, manifest} <- HashService.get_manifest(id) do
+      send_manifest(conn, manifest)
+    else
+      {:error, :not_found} ->
+        json_error(conn, 404, "Hash result #{id} not found")
+
+      {:error, :no_manifest} ->
+        json_error(conn, 404, "Hash result #{id} was stored without a manifest")
+
+      {:error, reason} ->
+        Logger.error("HashController: Unauthorized action: #{inspect(reason)}")
+        json_error(conn, 403, "Unauthorized")
+    end
+  end
+
+  # Whoever may submit a hash result may also upload its content
+  defp missing_chunks(conn) do
+    claims = conn.assigns[:current_user]
+    id = conn.path_params["id"]
+
+    with :ok <- ApiKeyService.authorize_action(claims, :submit_hash_result),
+         {:ok, hash_result, hashes} <- HashService.missing_chunks(id) do
+      conn
+      |> put_resp_content_type("application/json")
+      |> send_resp(200, Jason.encode!(%{id: hash_result.id, algorithm: hash_result.hash_algorithm, missing: hashes, encodings: @chunk_encodings}))
+    else
+      {:error, :not_found} ->
+        json_error(conn, 404, "Hash result #{id} not found")
+
+      {:error, reason} ->
+        Logger.error("HashController: Unauthorized action: #{inspect(reason)}")
+        json_error(conn, 403, "Unauthorized")
+    end
+  end
+
+  # The body is the chunk, raw or zstd-compressed; it is only stored if the
+  # uncompressed bytes match the digest
+  defp upload_chunk(conn) do
+    claims = conn.assigns[:current_user]
+    id = conn.path_params["id"]
+    hash = conn.path_params["hash"]
+
+    with :ok <- ApiKeyService.authorize_action(claims, :submit_hash_result),
+         {:ok, content, conn} <- read_chunk_body(conn),
+         {:ok, content} <- decode_chunk(conn, content),
+         {:ok, chunk_hash} <- HashService.store_chunk(id, hash, content) do
+      conn
+      |> put_resp_content_type("application/json")
+      |> send_resp(200, Jason.encode!(%{hash: chunk_hash.hash, size: chunk_hash.size, status: chunk_hash.status}))
+    else
+      {:error, :not_found} ->
+        json_error(conn, 404, "Hash result #{id} not found")
+
+      {:error, :unknown_chunk} ->
+        json_error(conn, 404, "Chunk #{hash} is not part of hash result #{id}")
+
+      {:error, :digest_mismatch} ->
+        json_error(conn, 422, "Chunk content does not match digest #{hash}")
+
+      {:error, :too_large} ->
+        json_error(conn, 413, "Chunk is larger than #{@max_chunk_length} bytes")
+
+      {:error, {:unsupported_encoding, encoding}} ->
+        json_error(conn, 415, "Unsupported chunk encoding #{encoding}")
+
+      {:error, {:decode, reason}} ->
+        Logger.error("HashController: Failed to decompress chunk #{hash}: #{inspect(reason)}")
+        json_error(conn, 400, "Failed to decompress chunk body")
+
+      {:error, {:read_body, reason}} ->
+        Logger.error("HashController: Failed to read chunk #{hash}: #{inspect(reason)}")
+        json_error(conn, 400, "Failed to read chunk body")
+
+      {:error, %Ecto.Changeset{} = changeset} ->
+        Logger.error("HashController: Failed to store chunk #{hash}: #{inspect(changeset.errors)}")
+        json_error(conn, 500, "Failed to store chunk")
+
+      {:error, reason} ->
+        Logger.error("HashController: Unauthorized action: #{inspect(reason)}")
+        json_error(conn, 403, "Unauthorized")
+    end
+  end
+
+  defp download_chunk(conn) do
+    claims = conn.assigns[:current_user]
+    id = conn.path_params["id"]
+    hash = conn.path_params["hash"]
+
+    with :ok <- ApiKeyService.authorize_action(claims, :get_hash_result),
+         {:ok, content} <- HashService.fetch_chunk(id, hash) do
+      conn
+      |> put_resp_content_type("application/octet-stream", nil)
+      |> put_resp_header("vary", "accept-encoding")
+      |> send_chunk(content)
+    else
+      {:error, :not_found} ->
+        json_error(conn, 404, "Hash result #{id} not found")
+
+      {:error, :unknown_chunk} ->
+        json_error(conn, 404, "Chunk #{hash} is not part of hash result #{id}")
+
+      {:error, :not_stored} ->
+        json_error(conn, 409, "Chunk #{hash} has not been pushed yet")
+
+      {:error, reason} ->
+        Logger.error("HashController: Unauthorized action: #{inspect(reason)}")
+        json_error(conn, 403, "Unauthorized")
+    end
+  end
+
+  defp read_chunk_body(conn, acc \\ []) do
+    case read_body(conn) do
+      {:ok, body, conn} -> check_chunk_length(IO.iodata_to_binary([acc, body]), conn)
+      {:more, body, conn} ->
+        if IO.iodata_length([acc, body]) > @max_chunk_length do
+          {:error, :too_large}
+        else
+          read_chunk_body(conn, [acc, body])
+        end
+      {:error, reason} -> {:error, {:read_body, reason}}
+    end
+  end
+
+  defp check_chunk_length(content, _conn) when byte_size(content) > @max_chunk_length, do: {:error, :too_large}
+  defp check_chunk_length(content, conn), do: {:ok, content, conn}
+
+  defp decode_chunk(conn, content) do
+    case get_req_header(conn, "content-encoding") do
+      [] -> {:ok, content}
+      ["identity"] -> {:ok, content}
+      ["zstd"] -> decompress_chunk(content)
+      [encoding | _] -> {:error, {:unsupported_encoding, encoding}}
+    end
+  end
+
+  # Bounded by the frame headers before anything is decompressed
+  defp decompress_chunk(content) do
+    case Zstd.decompress(content, @max_chunk_length) do
+      {:ok, decompressed} -> {:ok, decompressed}
+      {:error, :too_large} -> {:error, :too_large}
+      {:error, reason} -> {:error, {:decode, reason}}
+    end
+  end
+
+  # Chunks are compressed for clients that accept zstd, unless that does not
+  # make them smaller
+  defp send_chunk(conn, content) do
+    with true <- accepts_zstd?(conn),
+         compressed when is_binary(compressed) <- :ezstd.compress(content, @zstd_level),
+         true <- byte_size(compressed) < byte_size(content) do
+      conn
+      |> put_resp_header("content-encoding", "zstd")
+      |> send_resp(200, compressed)
+    else
+      _ -> send_resp(conn, 200, content)
+    end
+  end
+
+  defp accepts_zstd?(conn) do
+    conn
+    |> get_req_header("accept-encoding")
+    |> Enum.flat_map(&String.split(&1, ","))
+    |> Enum.any?(fn encoding -> encoding |> String.split(";") |> hd() |> String.trim() == "zstd" end)
+  end
+
+  defp send_manifest(conn, {:ndjson, manifest}) do
+    conn
+    |> put_resp_content_type("application/x-ndjson")
+    |> send_resp(200, manifest)
+  end
+
+  defp send_manifest(conn, manifest) do
+    conn
+    |> put_resp_content_type("application/json")
+    |> send_resp(200, Jason.encode!(manifest))
+  end
+
+  defp json_error(conn, status, message) do
+    conn
+    |> put_resp_content_type("application/json")
+    |> send_resp(status, Jason.encode!(%{error: message}))
+  end
+
   defp receive_hash(conn) do
     Logger.info("HashController: Receiving hash")
     claims = conn.assigns[:current_user]
@@ -35,7 +244,7 @@ defmodule HiveforgeController.HashController do
   defp process_hash(conn) do
     case parse_body(conn) do
       {:ok, hash_result} ->
-        case HashService.process_hash_result(hash_result) do
+        case store_hash_result(hash_result) do
           {:ok, processed_result} ->
             Logger.debug("Processed result: #{inspect(processed_result)}")
             response = %{
@@ -83,6 +292,9 @@ defmodule HiveforgeController.HashController do
     end
   end
 
+  defp store_hash_result({:ndjson, manifest}), do: HashService.process_hash_stream(manifest)
+  defp store_hash_result(hash_result), do: HashService.process_hash_result(hash_result)
+
   defp parse_body(conn) do
     Logger.debug("HashController: Parsing body")
     case conn.assigns[:raw_body] do
@@ -91,12 +303,28 @@ defmodule HiveforgeController.HashController do
         {:error, "No raw body found"}
       raw_body ->
         Logger.debug("HashController: Raw body found, size: #{byte_size(raw_body)} bytes")
-        case Jason.decode(raw_body) do
-          {:ok, parsed} -> {:ok, parsed}
-          {:error, reason} ->
-            Logger.error("HashController: JSON parsing error: #{inspect(reason)}")
-            {:error, reason}
+        if ndjson?(conn) do
+          # Streamed manifests are decoded record by record in HashService
+          {:ok, {:ndjson, raw_body}}
+        else
+          decode_json(raw_body)
         end
     end
   end
+
+  defp ndjson?(conn) do
+    case get_req_header(conn, "content-type") do
+      ["application/x-ndjson" <> _] -> true
+      _ -> false
+    end
+  end
+
+  defp decode_json(raw_body) do
+    case Jason.decode(raw_body) do
+      {:ok, parsed} -> {:ok, parsed}
+      {:error, reason} ->
+        Logger.error("HashController: JSON parsing error: #{inspect(reason)}")
+        {:error, reason}
+    end
+  end
 end
@@ -3,6 +3,7 @@ defmodule HiveforgeController.HashService do
   alias HiveforgeController.Repo
   alias HiveforgeController.Schemas.{HashResult, FileHash, ChunkHash, FileChunkMap}
   import Ecto.Query
+  require Logger
 
   def process_hash_result(json_data) do
     Repo.transaction(fn ->
@@ -15,14 +16,85 @@ defmodule HiveforgeController.HashService do
     end)
   end
 
-  defp create_hash_result(json_data) do
+  # Streamed manifests are NDJSON: a header, one record per file, symlink and
+  # directory, and a trailer with the totals. The hash result is created from
+  # the header and completed by the trailer, one line at a time. The body
+  # arrives as one binary and is stored verbatim in manifest_ndjson, so the
+  # manifest still has to fit in memory here.
+  def process_hash_stream(ndjson) do
+    Repo.transaction(fn ->
+      result =
+        ndjson
+        |> String.splitter("\n", trim: true)
+        |> Enum.reduce_while({:ok, nil}, fn line, {:ok, hash_result} ->
+          with {:ok, record} <- Jason.decode(line),
+               {:ok, hash_result} <- process_record(hash_result, record, ndjson) do
+            {:cont, {:ok, hash_result}}
+          else
+            {:error, reason} -> {:halt, {:error, reason}}
+          end
+        end)
+
+      case result do
+        {:ok, %HashResult{status: "completed"} = hash_result} -> hash_result
+        {:ok, _} -> Repo.rollback(:missing_trailer)
+        {:error, reason} -> Repo.rollback(reason)
+      end
+    end)
+  end
+
+  defp process_record(nil, %{"record" => "header"} = header, ndjson) do
+    # Totals are only known once the trailer arrives
+    header
+    |> Map.merge(%{"files" => 0, "size" => 0, "time" => 0.0})
+    |> create_hash_result(%{status: "pending", manifest: nil, manifest_ndjson: ndjson})
+  end
+
+  defp process_record(nil, _record, _ndjson), do: {:error, :missing_header}
+
+  defp process_record(hash_result, %{"record" => "entry", "type" => "file"} = file, _ndjson) do
+    case process_file(hash_result, file) do
+      :ok -> {:ok, hash_result}
+      {:error, reason} -> {:error, reason}
+    end
+  end
+
+  # Directories and symlinks only matter for the stored manifest
+  defp process_record(hash_result, %{"record" => "entry"}, _ndjson), do: {:ok, hash_result}
+
+  defp process_record(%HashResult{status: "pending"} = hash_result, %{"record" => "trailer"} = trailer, _ndjson) do
+    hash_result
+    |> HashResult.changeset(%{
+      root_digest: trailer["rootDigest"],
+      total_files: trailer["files"],
+      total_size: trailer["size"],
+      hashing_time: trailer["time"],
+      status: "completed"
+    })
+    |> Repo.update()
+  end
+
+  defp process_record(_hash_result, record, _ndjson), do: {:error, {:unexpected_record, record["record"]}}
+
+  defp create_hash_result(json_data, overrides \\ %{}) do
+    # Manifests from older clients carry no chunking block and always used fixed-size chunks
+    chunking = json_data["chunking"] || %{}
+
     attrs = %{
       root_path: json_data["root"],
+      root_digest: json_data["rootDigest"],
+      hash_algorithm: json_data["algorithm"] || "blake3",
       total_files: json_data["files"],
       total_size: json_data["size"],
       hashing_time: json_data["time"],
+      chunk_scheme: chunking["scheme"] || "fixed",
+      min_chunk_size: chunking["minSize"],
+      avg_chunk_size: chunking["avgSize"],
+      max_chunk_size: chunking["maxSize"],
+      manifest: json_data,
       status: "completed"
     }
+    |> Map.merge(overrides)
 
     %HashResult{}
     |> HashResult.changeset(attrs)
@@ -30,10 +102,12 @@ defmodule HiveforgeController.HashService do
   end
 
   defp process_files(hash_result, files) when is_list(files) do
-    Enum.each(files, fn file ->
-      process_file(hash_result, file)
+    Enum.reduce_while(files, :ok, fn file, :ok ->
+      case process_file(hash_result, file) do
+        :ok -> {:cont, :ok}
+        {:error, reason} -> {:halt, {:error, reason}}
+      end
     end)
-    :ok
   end
 
   defp process_files(hash_result, %{"children" => children}) do
@@ -55,22 +129,25 @@ defmodule HiveforgeController.HashService do
       chunk_size: file["hashes"]["chunkSize"],
       chunk_count: file["hashes"]["chunkCount"],
       total_size: file["size"],
+      digest: file["hashes"]["digest"],
+      mode: file["mode"],
       status: "completed",
       hash_result_id: hash_result.id
     }
 
-    {:ok, file_hash} =
-      %FileHash{}
-      |> FileHash.changeset(attrs)
-      |> Repo.insert()
-
-    process_chunks(file_hash, file["hashes"]["hashes"])
+    case %FileHash{} |> FileHash.changeset(attrs) |> Repo.insert() do
+      {:ok, file_hash} -> process_chunks(file_hash, file["hashes"]["hashes"])
+      {:error, changeset} -> {:error, {:invalid_file, file["name"], changeset}}
+    end
   end
 
   defp process_file(hash_result, %{"type" => "directory", "children" => children}) do
     process_files(hash_result, children)
   end
 
+  # Recorded symlinks only carry a target path, there is no content to store
+  defp process_file(_hash_result, %{"type" => "symlink"}), do: :ok
+
   defp process_file(hash_result, unexpected) do
     Logger.error("Unexpected structure in process_file: #{inspect(unexpected)}")
     {:error, :unexpected_structure}
@@ -79,8 +156,11 @@ defmodule HiveforgeController.HashService do
   defp process_chunks(file_hash, chunks) do
     chunks
     |> Enum.with_index(1)  # Start index at 1
-    |> Enum.each(fn {chunk, index} ->
-      process_chunk(file_hash, chunk, index)
+    |> Enum.reduce_while(:ok, fn {chunk, index}, :ok ->
+      case process_chunk(file_hash, chunk, index) do
+        {:ok, _file_chunk_map} -> {:cont, :ok}
+        {:error, reason} -> {:halt, {:error, reason}}
+      end
     end)
   end
 
@@ -91,21 +171,20 @@ defmodule HiveforgeController.HashService do
   end
 
   defp process_chunk(file_hash, chunk, sequence) do
-    chunk_hash = get_or_create_chunk_hash(chunk)
-    create_file_chunk_map(file_hash, chunk_hash, sequence)
+    with {:ok, chunk_hash} <- get_or_create_chunk_hash(chunk) do
+      create_file_chunk_map(file_hash, chunk_hash, sequence)
+    end
   end
 
   defp get_or_create_chunk_hash(chunk) do
     case Repo.one(from ch in ChunkHash, where: ch.hash == ^chunk, limit: 1) do
       nil ->
-        {:ok, chunk_hash} =
-          %ChunkHash{}
-          |> ChunkHash.changeset(%{hash: chunk, status: "missing"})
-          |> Repo.insert()
-        chunk_hash
+        %ChunkHash{}
+        |> ChunkHash.changeset(%{hash: chunk, status: "missing"})
+        |> Repo.insert()
 
       existing_chunk ->
-        existing_chunk
+        {:ok, existing_chunk}
     end
   end
 
@@ -137,6 +216,94 @@ defmodule HiveforgeController.HashService do
     |> Repo.update()
   end
 
+  # Distinct chunks of a hash result whose content has not been uploaded yet
+  def missing_chunks(hash_result_id) do
+    with {:ok, hash_result} <- fetch_hash_result(hash_result_id) do
+      hashes =
+        Repo.all(from fcm in FileChunkMap,
+          join: ch in ChunkHash, on: fcm.chunk_hash_id == ch.id,
+          join: fh in FileHash, on: fcm.file_hash_id == fh.id,
+          where: fh.hash_result_id == ^hash_result.id and ch.status == "missing",
+          distinct: true,
+          select: ch.hash
+        )
+      {:ok, hash_result, hashes}
+    end
+  end
+
+  # Stores the content of a chunk referenced by the hash result after checking
+  # it against the digest, computed with the result's algorithm. A chunk that
+  # is already stored is left as it is.
+  def store_chunk(hash_result_id, hash, content) do
+    with {:ok, hash_result} <- fetch_hash_result(hash_result_id),
+         {:ok, chunk_hash} <- chunk_of(hash_result, hash),
+         :ok <- verify_chunk(hash_result.hash_algorithm, hash, content) do
+      case chunk_hash.status do
+        "stored" ->
+          {:ok, chunk_hash}
+
+        _ ->
+          chunk_hash
+          |> ChunkHash.changeset(%{content: content, size: byte_size(content), status: "stored"})
+          |> Repo.update()
+      end
+    end
+  end
+
+  # Content of a chunk referenced by the hash result, once it has been uploaded
+  def fetch_chunk(hash_result_id, hash) do
+    with {:ok, hash_result} <- fetch_hash_result(hash_result_id),
+         {:ok, chunk_hash} <- chunk_of(hash_result, hash) do
+      case chunk_hash do
+        %ChunkHash{status: "stored", content: content} when is_binary(content) -> {:ok, content}
+        _ -> {:error, :not_stored}
+      end
+    end
+  end
+
+  defp chunk_of(hash_result, hash) do
+    query =
+      from ch in ChunkHash,
+      join: fcm in FileChunkMap, on: fcm.chunk_hash_id == ch.id,
+      join: fh in FileHash, on: fcm.file_hash_id == fh.id,
+      where: fh.hash_result_id == ^hash_result.id and ch.hash == ^hash,
+      limit: 1
+    case Repo.one(query) do
+      nil -> {:error, :unknown_chunk}
+      chunk_hash -> {:ok, chunk_hash}
+    end
+  end
+
+  defp verify_chunk(algorithm, hash, content) do
+    if chunk_digest(algorithm, content) == String.downcase(hash) do
+      :ok
+    else
+      {:error, :digest_mismatch}
+    end
+  end
+
+  def chunk_digest("sha256", content), do: :crypto.hash(:sha256, content) |> Base.encode16(case: :lower)
+  def chunk_digest(_blake3, content), do: B3.hash(content) |> Base.encode16(case: :lower)
+
+  def get_manifest(hash_result_id) do
+    with {:ok, hash_result} <- fetch_hash_result(hash_result_id) do
+      manifest_of(hash_result)
+    end
+  end
+
+  defp fetch_hash_result(hash_result_id) do
+    with {id, ""} <- Integer.parse(to_string(hash_result_id)),
+         %HashResult{} = hash_result <- Repo.get(HashResult, id) do
+      {:ok, hash_result}
+    else
+      _ -> {:error, :not_found}
+    end
+  end
+
+  defp manifest_of(%HashResult{manifest_ndjson: ndjson}) when is_binary(ndjson), do: {:ok, {:ndjson, ndjson}}
+  defp manifest_of(%HashResult{manifest: nil}), do: {:error, :no_manifest}
+  defp manifest_of(%HashResult{manifest: manifest}), do: {:ok, manifest}
+
   def get_hash_result_by_root_path(root_path) do
     Repo.get_by(HashResult, root_path: root_path)
   end
@@ -34,6 +34,22 @@ defmodule HiveforgeController.ProtectedRouter do
     HiveforgeController.HashController.call(conn, action: :receive_hash)
   )
 
+  get("/hash-results/:id", do:
+    HiveforgeController.HashController.call(conn, action: :get_manifest)
+  )
+
+  get("/hash-results/:id/missing-chunks", do:
+    HiveforgeController.HashController.call(conn, action: :missing_chunks)
+  )
+
+  get("/hash-results/:id/chunks/:hash", do:
+    HiveforgeController.HashController.call(conn, action: :download_chunk)
+  )
+
+  put("/hash-results/:id/chunks/:hash", do:
+    HiveforgeController.HashController.call(conn, action: :upload_chunk)
+  )
+
 
   # Jobs
   get("/jobs", do: HiveforgeController.JobController.call(conn, action: :list_jobs))
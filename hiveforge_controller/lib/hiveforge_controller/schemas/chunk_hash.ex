@@ -5,6 +5,9 @@ defmodule HiveforgeController.Schemas.ChunkHash do
   schema "chunk_hashes" do
     field :hash, :string
     field :status, :string, default: "pending"
+    # Uploaded bytes; set once the status is "stored"
+    field :content, :binary
+    field :size, :integer
 
     has_many :file_chunk_maps, HiveforgeController.Schemas.FileChunkMap
     has_many :file_hashes, through: [:file_chunk_maps, :file_hash]
@@ -14,7 +17,7 @@ defmodule HiveforgeController.Schemas.ChunkHash do
 
   def changeset(chunk_hash, attrs) do
     chunk_hash
-    |> cast(attrs, [:hash, :status])
+    |> cast(attrs, [:hash, :status, :content, :size])
     |> validate_required([:hash])
     |> unique_constraint(:hash)
   end
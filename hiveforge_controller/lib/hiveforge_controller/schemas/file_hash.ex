@@ -7,6 +7,8 @@ defmodule HiveforgeController.Schemas.FileHash do
     field :chunk_size, :integer
     field :chunk_count, :integer
     field :total_size, :integer
+    field :digest, :string
+    field :mode, :integer
     field :status, :string, default: "pending"
 
     belongs_to :hash_result, HiveforgeController.Schemas.HashResult
@@ -18,7 +20,7 @@ defmodule HiveforgeController.Schemas.FileHash do
 
   def changeset(file_hash, attrs) do
     file_hash
-    |> cast(attrs, [:file_name, :chunk_size, :chunk_count, :total_size, :status, :hash_result_id])
+    |> cast(attrs, [:file_name, :chunk_size, :chunk_count, :total_size, :digest, :mode, :status, :hash_result_id])
     |> validate_required([:file_name, :total_size, :hash_result_id])
   end
 end
@@ -4,17 +4,30 @@ defmodule HiveforgeController.Schemas.HashResult do
 
   schema "hash_results" do
     field :root_path, :string
+    field :root_digest, :string
+    field :hash_algorithm, :string, default: "blake3"
     field :total_files, :integer
     field :total_size, :integer
     field :hashing_time, :float
     field :status, :string, default: "pending"
+    field :chunk_scheme, :string, default: "fixed"
+    field :min_chunk_size, :integer
+    field :avg_chunk_size, :integer
+    field :max_chunk_size, :integer
+    # The manifest as submitted, so clients can fetch it back as a snapshot
+    field :manifest, :map
+    # Streamed (NDJSON) manifests are kept verbatim instead
+    field :manifest_ndjson, :string
     has_many :file_hashes, HiveforgeController.Schemas.FileHash
     timestamps()
   end
 
   def changeset(hash_result, attrs) do
     hash_result
-    |> cast(attrs, [:root_path, :total_files, :total_size, :hashing_time, :status])
+    |> cast(attrs, [:root_path, :root_digest, :hash_algorithm, :total_files, :total_size, :hashing_time, :status,
+                    :chunk_scheme, :min_chunk_size, :avg_chunk_size, :max_chunk_size, :manifest, :manifest_ndjson])
     |> validate_required([:root_path, :total_files, :total_size, :hashing_time])
+    |> validate_inclusion(:chunk_scheme, ["fixed", "fastcdc"])
+    |> validate_inclusion(:hash_algorithm, ["blake3", "sha256"])
   end
 end
@@ -0,0 +1,103 @@
+defmodule HiveforgeController.Zstd do
+  @moduledoc """
+  Bounded zstd decompression of chunk uploads.
+
+  `:ezstd.decompress/1` allocates whatever a frame asks for, so a few KB of
+  crafted input could claim gigabytes. The frame and block headers are walked
+  first to work out how large the output can get, and only input within the
+  limit is decompressed.
+  """
+  import Bitwise
+
+  @frame_magic 0xFD2FB528
+  @skippable_magic_min 0x184D2A50
+  @skippable_magic_max 0x184D2A5F
+  # A block never regenerates more than this (Block_Maximum_Size)
+  @max_block_size 128 * 1024
+
+  @spec decompress(binary, non_neg_integer) :: {:ok, binary} | {:error, :too_large} | {:error, term}
+  def decompress(data, max_size) do
+    with {:ok, bound} <- output_bound(data, 0),
+         :ok <- check_bound(bound, max_size) do
+      case :ezstd.decompress(data) do
+        decompressed when is_binary(decompressed) and byte_size(decompressed) <= max_size -> {:ok, decompressed}
+        decompressed when is_binary(decompressed) -> {:error, :too_large}
+        {:error, reason} -> {:error, reason}
+      end
+    end
+  end
+
+  defp check_bound(bound, max_size) when bound > max_size, do: {:error, :too_large}
+  defp check_bound(_bound, _max_size), do: :ok
+
+  # The largest output data can decompress to, frame by frame: the declared
+  # content size, which decoders enforce, or else the sum of the block limits
+  defp output_bound(<<>>, total), do: {:ok, total}
+
+  defp output_bound(<<magic::little-32, size::little-32, rest::binary>>, total)
+       when magic >= @skippable_magic_min and magic <= @skippable_magic_max do
+    case rest do
+      <<_::binary-size(size), rest::binary>> -> output_bound(rest, total)
+      _ -> {:error, :truncated_frame}
+    end
+  end
+
+  defp output_bound(<<@frame_magic::little-32, descriptor, rest::binary>>, total) do
+    <<fcs_flag::2, single_segment::1, _unused::1, _reserved::1, checksum::1, dict_flag::2>> = <<descriptor>>
+    skip = if(single_segment == 1, do: 0, else: 1) + elem({0, 1, 2, 4}, dict_flag)
+    fcs_bits = 8 * content_size_bytes(fcs_flag, single_segment)
+    checksum_size = 4 * checksum
+
+    with <<_::binary-size(skip), fcs::little-size(fcs_bits), blocks::binary>> <- rest,
+         {:ok, block_bound, rest} <- blocks_bound(blocks, 0),
+         <<_::binary-size(checksum_size), rest::binary>> <- rest do
+      frame_bound =
+        case fcs_bits do
+          0 -> block_bound
+          16 -> min(fcs + 256, block_bound)
+          _ -> min(fcs, block_bound)
+        end
+
+      output_bound(rest, total + frame_bound)
+    else
+      {:error, reason} -> {:error, reason}
+      _ -> {:error, :truncated_frame}
+    end
+  end
+
+  defp output_bound(_data, _total), do: {:error, :not_zstd}
+
+  defp content_size_bytes(0, 0), do: 0
+  defp content_size_bytes(0, 1), do: 1
+  defp content_size_bytes(1, _), do: 2
+  defp content_size_bytes(2, _), do: 4
+  defp content_size_bytes(3, _), do: 8
+
+  defp blocks_bound(<<header::little-24, rest::binary>>, total) do
+    last = header &&& 1
+    size = header >>> 3
+
+    {stored, regenerated} =
+      case (header >>> 1) &&& 3 do
+        0 -> {size, size}
+        1 -> {1, size}
+        2 -> {size, @max_block_size}
+        3 -> {:reserved, 0}
+      end
+
+    cond do
+      stored == :reserved ->
+        {:error, :reserved_block_type}
+
+      byte_size(rest) < stored ->
+        {:error, :truncated_frame}
+
+      true ->
+        <<_::binary-size(stored), rest::binary>> = rest
+        total = total + min(regenerated, @max_block_size)
+        if last == 1, do: {:ok, total, rest}, else: blocks_bound(rest, total)
+    end
+  end
+
+  defp blocks_bound(_data, _total), do: {:error, :truncated_frame}
+end
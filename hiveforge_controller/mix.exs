@@ -39,7 +39,8 @@ defmodule HiveforgeController.MixProject do
       {:postgrex, "~> 0.18"},
       {:ecto_sql, "~> 3.11"},
       {:joken, "~> 2.6"},
-      {:b3, "~> 0.1"}
+      {:b3, "~> 0.1"},
+      {:ezstd, "~> 1.1"}
     ]
   end
 end
@@ -0,0 +1,12 @@
+defmodule HiveforgeController.Repo.Migrations.AddChunkingToHashResults do
+  use Ecto.Migration
+
+  def change do
+    alter table(:hash_results) do
+      add :chunk_scheme, :string, default: "fixed", null: false
+      add :min_chunk_size, :integer
+      add :avg_chunk_size, :integer
+      add :max_chunk_size, :integer
+    end
+  end
+end
@@ -0,0 +1,11 @@
+defmodule HiveforgeController.Repo.Migrations.AddDigestToFileHashes do
+  use Ecto.Migration
+
+  def change do
+    alter table(:file_hashes) do
+      add :digest, :string
+    end
+
+    create index(:file_hashes, [:digest])
+  end
+end
@@ -0,0 +1,11 @@
+defmodule HiveforgeController.Repo.Migrations.AddRootDigestToHashResults do
+  use Ecto.Migration
+
+  def change do
+    alter table(:hash_results) do
+      add :root_digest, :string
+    end
+
+    create index(:hash_results, [:root_digest])
+  end
+end
@@ -0,0 +1,9 @@
+defmodule HiveforgeController.Repo.Migrations.AddModeToFileHashes do
+  use Ecto.Migration
+
+  def change do
+    alter table(:file_hashes) do
+      add :mode, :integer
+    end
+  end
+end
@@ -0,0 +1,9 @@
+defmodule HiveforgeController.Repo.Migrations.AddHashAlgorithmToHashResults do
+  use Ecto.Migration
+
+  def change do
+    alter table(:hash_results) do
+      add :hash_algorithm, :string, default: "blake3", null: false
+    end
+  end
+end
@@ -0,0 +1,9 @@
+defmodule HiveforgeController.Repo.Migrations.AddManifestToHashResults do
+  use Ecto.Migration
+
+  def change do
+    alter table(:hash_results) do
+      add :manifest, :map
+    end
+  end
+end
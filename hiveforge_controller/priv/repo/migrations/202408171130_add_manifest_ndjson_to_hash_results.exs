@@ -0,0 +1,9 @@
+defmodule HiveforgeController.Repo.Migrations.AddManifestNdjsonToHashResults do
+  use Ecto.Migration
+
+  def change do
+    alter table(:hash_results) do
+      add :manifest_ndjson, :text
+    end
+  end
+end
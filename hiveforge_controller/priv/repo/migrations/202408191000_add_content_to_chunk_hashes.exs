@@ -0,0 +1,10 @@
+defmodule HiveforgeController.Repo.Migrations.AddContentToChunkHashes do
+  use Ecto.Migration
+
+  def change do
+    alter table(:chunk_hashes) do
+      add :content, :binary
+      add :size, :integer
+    end
+  end
+end